@@ -1,14 +1,33 @@
 module github.com/blho/apexdns
 
-go 1.13
+go 1.24.1
 
 require (
+	github.com/ameshkov/dnscrypt/v2 v2.4.0
+	github.com/ameshkov/dnsstamps v1.0.3
 	github.com/caddyserver/caddy v1.0.4
-	github.com/miekg/dns v1.1.27
+	github.com/miekg/dns v1.1.65
 	github.com/oif/gokit v0.11.0
 	github.com/pborman/uuid v1.2.0
+	github.com/pires/go-proxyproto v0.7.0
+	github.com/quic-go/quic-go v0.59.1
 	github.com/sirupsen/logrus v1.4.2
 	github.com/spf13/cobra v0.0.5
 	github.com/spf13/pflag v1.0.3
-	golang.org/x/net v0.0.0-20200114155413-6afb5195e5aa
+	golang.org/x/net v0.43.0
+	golang.org/x/sys v0.35.0
+)
+
+require (
+	github.com/AdguardTeam/golibs v0.32.7 // indirect
+	github.com/google/uuid v1.6.0 // indirect
+	github.com/inconshreveable/mousetrap v1.0.0 // indirect
+	github.com/konsorten/go-windows-terminal-sequences v1.0.2 // indirect
+	github.com/quic-go/qpack v0.6.0 // indirect
+	golang.org/x/crypto v0.41.0 // indirect
+	golang.org/x/exp v0.0.0-20250305212735-054e65f0b394 // indirect
+	golang.org/x/mod v0.27.0 // indirect
+	golang.org/x/sync v0.16.0 // indirect
+	golang.org/x/text v0.28.0 // indirect
+	golang.org/x/tools v0.36.0 // indirect
 )
@@ -0,0 +1,57 @@
+package http
+
+import (
+	"net/http"
+	"strings"
+
+	"github.com/blho/apexdns/pkg/utils/tlsutil"
+)
+
+// Authenticator authenticates clients by verified client certificate, bearer token or path secret
+type Authenticator struct {
+	// tokens maps token to client identity
+	tokens     map[string]string
+	clientCert bool
+}
+
+func NewAuthenticator(tokens map[string]string, clientCert bool) *Authenticator {
+	return &Authenticator{
+		tokens:     tokens,
+		clientCert: clientCert,
+	}
+}
+
+// Enabled reports whether clients are required to be authenticated
+func (a *Authenticator) Enabled() bool {
+	return a.clientCert || len(a.tokens) > 0
+}
+
+// Authenticate returns the client identity and the request path with path secret stripped,
+// ok is false if authentication is enabled and client fails on all methods
+func (a *Authenticator) Authenticate(r *http.Request) (identity, path string, ok bool) {
+	path = r.URL.Path
+	if !a.Enabled() {
+		return "", path, true
+	}
+	if a.clientCert && r.TLS != nil {
+		if identity = tlsutil.PeerIdentity(*r.TLS); identity != "" {
+			return identity, path, true
+		}
+	}
+	if len(a.tokens) == 0 {
+		return "", path, false
+	}
+	// Bearer token
+	if authorization := r.Header.Get("Authorization"); len(authorization) > 7 && strings.EqualFold(authorization[:7], "Bearer ") {
+		if identity, ok = a.tokens[strings.TrimSpace(authorization[7:])]; ok {
+			return identity, path, true
+		}
+	}
+	// Path secret, e.g. /dns-query/<token>
+	if i := strings.LastIndexByte(path, '/'); i > 0 {
+		if identity, ok = a.tokens[path[i+1:]]; ok {
+			return identity, path[:i], true
+		}
+	}
+	return "", path, false
+}
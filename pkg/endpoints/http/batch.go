@@ -0,0 +1,103 @@
+package http
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"sync"
+
+	"github.com/blho/apexdns/pkg/constant"
+	"github.com/blho/apexdns/pkg/utils/dnsutil"
+
+	"github.com/miekg/dns"
+)
+
+const (
+	defaultBatchConcurrency = 16
+	defaultBatchMaxItems    = 100
+	// Max body size of batch request 4MB
+	maxBatchBodySize = 4 << 20
+)
+
+// serveBatch resolves the JSON array of GoogleDoHQuery concurrently,
+// and responses a JSON array of DNSResponse in request order
+func (e *Endpoint) serveBatch(w http.ResponseWriter, r *http.Request, identity string) {
+	if r.Method != http.MethodPost {
+		e.responseError(w, http.StatusMethodNotAllowed, errors.New("batch query requires POST"))
+		return
+	}
+	if !isJSONContentType(r.Header.Get("Content-Type")) {
+		e.responseError(w, http.StatusUnsupportedMediaType, fmt.Errorf("%w: %s", errUnsupportedMediaType, r.Header.Get("Content-Type")))
+		return
+	}
+	structured, ok := parseGenericBool(r.URL.Query().Get("structured"), false)
+	if !ok {
+		e.responseError(w, http.StatusBadRequest, fmt.Errorf("invalid structured: %s", r.URL.Query().Get("structured")))
+		return
+	}
+	var queries []GoogleDoHQuery
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxBatchBodySize)).Decode(&queries); err != nil {
+		var maxBytesErr *http.MaxBytesError
+		if errors.As(err, &maxBytesErr) {
+			e.responseError(w, http.StatusRequestEntityTooLarge, err)
+			return
+		}
+		e.responseError(w, http.StatusBadRequest, fmt.Errorf("invalid JSON body: %w", err))
+		return
+	}
+	if len(queries) > e.batchMaxItems {
+		e.responseError(w, http.StatusRequestEntityTooLarge, fmt.Errorf("too many queries in batch: %d > %d", len(queries), e.batchMaxItems))
+		return
+	}
+
+	var (
+		clientIP   = GetClientIPFromRequest(r)
+		disableECS = checkDisabledECS(r)
+		results    = make([]DNSResponse, len(queries))
+		sem        = make(chan struct{}, e.batchConcurrency)
+		wg         sync.WaitGroup
+	)
+	for i := range queries {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(i int) {
+			defer func() {
+				<-sem
+				wg.Done()
+			}()
+			results[i] = e.resolveBatchQuery(clientIP, identity, queries[i], disableECS, structured)
+		}(i)
+	}
+	wg.Wait()
+
+	payload, err := json.Marshal(results)
+	if err != nil {
+		e.responseError(w, http.StatusInternalServerError, err)
+		return
+	}
+	w.Header().Set("Content-Type", constant.ContentTypeApplicationJSON)
+	w.Write(payload)
+}
+
+func (e *Endpoint) resolveBatchQuery(clientIP net.IP, identity string, query GoogleDoHQuery, disableECS, structured bool) DNSResponse {
+	ctx := NewGoogleDoHContext(clientIP, query, disableECS)
+	if err := ctx.Error(); err != nil {
+		// Invalid query
+		return DNSResponse{
+			Status:   dns.RcodeFormatError,
+			Question: []DNSQuestion{{Name: query.Name}},
+			Answer:   []DNSRR{},
+			Comment:  err.Error(),
+		}
+	}
+	ctx.SetClientIdentity(identity)
+	e.handler(ctx)
+	// Failures are presented as SERVFAIL or REFUSED
+	resp := ParseDNSResponseFromMessage(dnsutil.Reply(ctx), structured)
+	if err := ctx.Error(); err != nil {
+		resp.Comment = err.Error()
+	}
+	return resp
+}
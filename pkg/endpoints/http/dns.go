@@ -2,8 +2,10 @@ package http
 
 import (
 	"fmt"
-	"github.com/miekg/dns"
+	"reflect"
 	"strings"
+
+	"github.com/miekg/dns"
 )
 
 // DNSResponse implements Google DoH protocol
@@ -28,11 +30,14 @@ type DNSQuestion struct {
 }
 type DNSRR struct {
 	DNSQuestion
-	TTL  uint32 `json:"TTL"`
-	Data string `json:"data"`
+	TTL uint32 `json:"TTL"`
+	// Data is the presentation format string of RDATA, or an object in structured mode
+	Data interface{} `json:"data"`
 }
 
-func ParseDNSResponseFromMessage(msg *dns.Msg) DNSResponse {
+// ParseDNSResponseFromMessage converts message to Google DoH response,
+// RDATA will be presented as object if structured is true
+func ParseDNSResponseFromMessage(msg *dns.Msg, structured bool) DNSResponse {
 	var resp DNSResponse
 	resp.Status = uint32(msg.Rcode)
 	resp.Truncated = msg.Truncated
@@ -50,25 +55,38 @@ func ParseDNSResponseFromMessage(msg *dns.Msg) DNSResponse {
 	}
 	resp.Answer = make([]DNSRR, len(msg.Answer))
 	for i, ans := range msg.Answer {
-		resp.Answer[i] = parseDNSRR(ans)
+		resp.Answer[i] = parseDNSRR(ans, structured)
 	}
 	resp.Authority = make([]DNSRR, len(msg.Ns))
 	for i, ns := range msg.Ns {
-		resp.Authority[i] = parseDNSRR(ns)
+		resp.Authority[i] = parseDNSRR(ns, structured)
+	}
+	for _, extra := range msg.Extra {
+		if extra.Header().Rrtype == dns.TypeOPT {
+			continue
+		}
+		resp.Additional = append(resp.Additional, parseDNSRR(extra, structured))
 	}
 	if edns0 := msg.IsEdns0(); edns0 != nil {
+		comments := []string{fmt.Sprintf("EDNS version %d, udp %d, do %t", edns0.Version(), edns0.UDPSize(), edns0.Do())}
 		for _, opt := range edns0.Option {
-			if o, ok := opt.(*dns.EDNS0_SUBNET); ok {
+			switch o := opt.(type) {
+			case *dns.EDNS0_SUBNET:
 				resp.EdnsClientSubnet = fmt.Sprintf("%s/%d", o.Address, o.SourceNetmask)
+			case *dns.EDNS0_EDE:
+				comment := fmt.Sprintf("EDE %d (%s)", o.InfoCode, dns.ExtendedErrorCodeToString[o.InfoCode])
+				if o.ExtraText != "" {
+					comment += ": " + o.ExtraText
+				}
+				comments = append(comments, comment)
 			}
 		}
+		resp.Comment = strings.Join(comments, "; ")
 	}
 	return resp
 }
 
-func parseDNSRR(raw dns.RR) DNSRR {
-	// Which defined 5 segments with separator `\t`
-	// e.g "apexdns.io IN CNAME homepage.cdn.apexdns.io"
+func parseDNSRR(raw dns.RR, structured bool) DNSRR {
 	rr := DNSRR{
 		DNSQuestion: DNSQuestion{
 			Name: raw.Header().Name,
@@ -76,9 +94,57 @@ func parseDNSRR(raw dns.RR) DNSRR {
 		},
 		TTL: raw.Header().Ttl,
 	}
-	segments := strings.SplitN(raw.String(), "\t", 5)
-	if len(segments) == 5 {
-		rr.Data = segments[4]
+	if structured {
+		rr.Data = structuredRData(raw)
+	} else {
+		// Presentation format without header
+		// e.g "apexdns.io. 300 IN CNAME homepage.cdn.apexdns.io." becomes "homepage.cdn.apexdns.io."
+		rr.Data = strings.TrimPrefix(raw.String(), raw.Header().String())
 	}
 	return rr
 }
+
+// structuredRData returns RDATA as object, fields are named after RR struct in lower case
+// except the well-known ones, e.g. `{"priority":10,"target":"mx.apexdns.io."}` for MX
+func structuredRData(raw dns.RR) map[string]interface{} {
+	switch rr := raw.(type) {
+	case *dns.MX:
+		return map[string]interface{}{
+			"priority": rr.Preference,
+			"target":   rr.Mx,
+		}
+	case *dns.SRV:
+		return map[string]interface{}{
+			"priority": rr.Priority,
+			"weight":   rr.Weight,
+			"port":     rr.Port,
+			"target":   rr.Target,
+		}
+	case *dns.SVCB:
+		return structuredSVCB(rr)
+	case *dns.HTTPS:
+		return structuredSVCB(&rr.SVCB)
+	}
+	data := make(map[string]interface{})
+	value := reflect.ValueOf(raw).Elem()
+	for i := 0; i < value.NumField(); i++ {
+		field := value.Type().Field(i)
+		if field.Name == "Hdr" || field.PkgPath != "" {
+			continue
+		}
+		data[strings.ToLower(field.Name)] = value.Field(i).Interface()
+	}
+	return data
+}
+
+func structuredSVCB(rr *dns.SVCB) map[string]interface{} {
+	params := make(map[string]string, len(rr.Value))
+	for _, kv := range rr.Value {
+		params[kv.Key().String()] = kv.String()
+	}
+	return map[string]interface{}{
+		"priority": rr.Priority,
+		"target":   rr.Target,
+		"params":   params,
+	}
+}
@@ -2,52 +2,171 @@ package http
 
 import (
 	"context"
+	"crypto/tls"
 	"encoding/base64"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"net"
 	"net/http"
+	"regexp"
 	"strconv"
 	"strings"
 	"time"
 
 	"github.com/blho/apexdns/pkg/constant"
 	"github.com/blho/apexdns/pkg/types"
+	"github.com/blho/apexdns/pkg/utils/dnsutil"
+	"github.com/blho/apexdns/pkg/utils/proxyprotocol"
+	"github.com/blho/apexdns/pkg/utils/tlsutil"
 	"github.com/miekg/dns"
+	"github.com/quic-go/quic-go/http3"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
 	"golang.org/x/net/idna"
 )
 
+var (
+	jsonpCallbackPattern = regexp.MustCompile(`^[A-Za-z_$][0-9A-Za-z_$.]*$`)
+
+	errPayloadTooLarge      = errors.New("DNS message too large")
+	errUnsupportedMediaType = errors.New("unsupported media type")
+)
+
+// Options of HTTP endpoint
+type Options struct {
+	// HTTP3 additionally serves HTTP/3 on the same UDP port, requires TLS
+	HTTP3 bool
+	// H2C serves cleartext HTTP/2, for running behind TLS-terminating load balancer
+	H2C bool
+	// Routes maps URL path to the accepted protocols, DefaultRoutes used if empty
+	Routes map[string][]string
+	// TrustedProxies whose forwarding headers are respected
+	TrustedProxies []*net.IPNet
+	// ProxyProtocol lists balancers which allowed to send PROXY protocol header
+	ProxyProtocol []*net.IPNet
+	// ClientCA verifies client certificates, requires TLS
+	ClientCA string
+	// AuthTokens maps bearer token or path secret to client identity
+	AuthTokens map[string]string
+	// BatchConcurrency limits concurrent queries of a single batch request
+	BatchConcurrency int
+	// BatchMaxItems limits queries of a single batch request
+	BatchMaxItems int
+}
+
 type Endpoint struct {
-	httpServer *http.Server
-	certFile   string
-	keyFile    string
-	stopCh     chan struct{}
-	userAgent  string
-	handler    types.ContextHandler
+	httpServer       *http.Server
+	http3Server      *http3.Server
+	tlsConfig        *tls.Config
+	proxyProtocol    []*net.IPNet
+	routes           map[string][]string
+	ipResolver       *ClientIPResolver
+	authenticator    *Authenticator
+	batchConcurrency int
+	batchMaxItems    int
+	stopCh           chan struct{}
+	userAgent        string
+	handler          types.ContextHandler
 }
 
-func New(listenAddress string, certFile, keyFile string, handler types.ContextHandler) (*Endpoint, error) {
+func New(listenAddress string, certFile, keyFile string, opts Options, handler types.ContextHandler) (*Endpoint, error) {
 	e := &Endpoint{
-		certFile:  certFile,
-		keyFile:   keyFile,
-		stopCh:    make(chan struct{}),
-		userAgent: "ApexDNS",
-		handler:   handler,
+		routes:           opts.Routes,
+		proxyProtocol:    opts.ProxyProtocol,
+		ipResolver:       NewClientIPResolver(opts.TrustedProxies),
+		authenticator:    NewAuthenticator(opts.AuthTokens, opts.ClientCA != ""),
+		batchConcurrency: opts.BatchConcurrency,
+		batchMaxItems:    opts.BatchMaxItems,
+		stopCh:           make(chan struct{}),
+		userAgent:        "ApexDNS",
+		handler:          handler,
+	}
+	if len(e.routes) == 0 {
+		e.routes = DefaultRoutes()
+	}
+	if e.batchConcurrency <= 0 {
+		e.batchConcurrency = defaultBatchConcurrency
+	}
+	if e.batchMaxItems <= 0 {
+		e.batchMaxItems = defaultBatchMaxItems
+	}
+	if certFile != "" || keyFile != "" {
+		tlsConfig, err := tlsutil.NewServerConfig(certFile, keyFile)
+		if err != nil {
+			return nil, err
+		}
+		e.tlsConfig = tlsConfig
 	}
-	httpServer := &http.Server{
-		Addr:    listenAddress,
-		Handler: e,
+	if opts.ClientCA != "" {
+		if e.tlsConfig == nil {
+			return nil, errors.New("client certificate authentication requires TLS")
+		}
+		// Client certificate is optional if token authentication is available
+		if err := tlsutil.SetClientCA(e.tlsConfig, opts.ClientCA, len(opts.AuthTokens) == 0); err != nil {
+			return nil, err
+		}
+	}
+	var httpHandler http.Handler = e
+	if opts.H2C {
+		if e.tlsConfig != nil {
+			return nil, errors.New("h2c is unavailable with TLS")
+		}
+		httpHandler = h2c.NewHandler(e, &http2.Server{})
+	}
+	e.httpServer = &http.Server{
+		Addr:      listenAddress,
+		Handler:   httpHandler,
+		TLSConfig: e.tlsConfig,
+	}
+	if opts.HTTP3 {
+		if e.tlsConfig == nil {
+			return nil, errors.New("HTTP/3 requires TLS")
+		}
+		e.http3Server = &http3.Server{
+			Addr:      listenAddress,
+			Handler:   e,
+			TLSConfig: http3.ConfigureTLSConfig(e.tlsConfig),
+		}
 	}
-	e.httpServer = httpServer
 	return e, nil
 }
 
 func (e *Endpoint) Run() error {
-	if e.certFile != "" || e.keyFile != "" {
-		return e.httpServer.ListenAndServeTLS(e.certFile, e.keyFile)
+	listener, err := net.Listen("tcp", e.httpServer.Addr)
+	if err != nil {
+		return err
+	}
+	if len(e.proxyProtocol) > 0 {
+		listener = proxyprotocol.NewListener(listener, e.proxyProtocol)
+	}
+	errCh := make(chan error, 2)
+	if e.http3Server != nil {
+		go func() {
+			errCh <- e.http3Server.ListenAndServe()
+		}()
+	}
+	go func() {
+		if e.tlsConfig != nil {
+			// Certificate served by TLS config
+			errCh <- e.httpServer.ServeTLS(listener, "", "")
+			return
+		}
+		errCh <- e.httpServer.Serve(listener)
+	}()
+	err = <-errCh
+	if err == http.ErrServerClosed {
+		return nil
+	}
+	if e.http3Server != nil {
+		// Don't leave the other server running if one of them failed
+		e.http3Server.Close()
+		e.httpServer.Close()
+		<-errCh
 	}
-	return e.httpServer.ListenAndServe()
+	return err
 }
 
 func (e *Endpoint) ServeHTTP(w http.ResponseWriter, r *http.Request) {
@@ -58,38 +177,67 @@ func (e *Endpoint) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Access-Control-Max-Age", "3600")
 	w.Header().Set("Server", e.userAgent)
 	w.Header().Set("X-Powered-By", e.userAgent)
+	if e.http3Server != nil {
+		// Advertise HTTP/3 by Alt-Svc
+		_ = e.http3Server.SetQUICHeaders(w.Header())
+	}
+
+	path := r.URL.Path
+	identity, authenticatedPath, authenticated := e.authenticator.Authenticate(r)
+	if authenticated {
+		// Path secret stripped
+		path = authenticatedPath
+	}
+	protocols, ok := e.routes[path]
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
 
 	if r.Method == "OPTIONS" {
 		w.Header().Set("Content-Length", "0")
 		return
 	}
 
+	if !authenticated {
+		w.Header().Set("WWW-Authenticate", "Bearer")
+		e.responseError(w, http.StatusUnauthorized, errors.New("unauthorized"))
+		return
+	}
+
+	r = withClientIP(r, e.ipResolver.Resolve(r))
+	if protocols[0] == ProtocolBatch {
+		e.serveBatch(w, r, identity)
+		return
+	}
 	if r.Form == nil {
 		// Max body size 16MB
 		r.ParseMultipartForm(16 << 20)
 	}
 
-	var ctx *types.Context
-	for _, parse := range []func(*http.Request) *types.Context{
-		ParseGoogleDoHProtocol,
-		ParseIETFDoHProtocol,
-	} {
-		ctx = parse(r)
-		if ctx != nil {
-			break
-		}
-	}
+	ctx, protocol := parseContextByProtocols(r, protocols)
 	if ctx == nil {
 		// Mismatch DoH protocol
-		w.Write([]byte(`{"error":"unknown DoH protocol"}`))
-		w.WriteHeader(http.StatusBadRequest)
+		if contentType := r.Header.Get("Content-Type"); r.Method == http.MethodPost && !acceptsMediaType(protocols, contentType) {
+			e.responseError(w, http.StatusUnsupportedMediaType, fmt.Errorf("%w: %s", errUnsupportedMediaType, contentType))
+			return
+		}
+		e.responseError(w, http.StatusBadRequest, errors.New("unknown DoH protocol"))
 		return
 	}
+	if err := ctx.Error(); err != nil {
+		e.responseError(w, statusOfRequestError(err), err)
+		return
+	}
+	ctx.SetClientIdentity(identity)
 	// Handle with context
 	e.handler(ctx)
 	// Check which content type should response
-	// Default as JSON
+	// Default as JSON, or DNS message for RFC 8484 query
 	contentType := constant.ContentTypeApplicationJSON
+	if protocol == ProtocolIETF {
+		contentType = constant.ContentTypeApplicationDNSMessage
+	}
 	if ct := r.FormValue("ct"); ct != "" {
 		// Try Google Protocol
 		contentType = ct
@@ -116,7 +264,7 @@ func (e *Endpoint) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		// Default use JSON
 		fallthrough
 	case constant.ContentTypeApplicationXJavascript, constant.ContentTypeApplicationJSON, constant.ContentTypeApplicationDNSJSON:
-		e.responseOnJSON(ctx, w)
+		e.responseOnJSON(ctx, w, r, contentType)
 	}
 }
 
@@ -128,6 +276,11 @@ func (e *Endpoint) Close() error {
 	}
 	ctx, cancel := context.WithTimeout(context.Background(), time.Second*30)
 	defer cancel()
+	if e.http3Server != nil {
+		if err := e.http3Server.Shutdown(ctx); err != nil {
+			return err
+		}
+	}
 	if err := e.httpServer.Shutdown(ctx); err != nil {
 		return err
 	}
@@ -141,14 +294,79 @@ func checkDisabledECS(r *http.Request) bool {
 	return false
 }
 
+// GoogleDoHQuery is the query of Google JSON API, given by URL parameters or JSON body
+type GoogleDoHQuery struct {
+	Name             string         `json:"name"`
+	Type             flexibleString `json:"type"`
+	CD               flexibleString `json:"cd"`
+	DO               flexibleString `json:"do"`
+	EdnsClientSubnet string         `json:"edns_client_subnet"`
+}
+
+// flexibleString accepts JSON string, number and boolean, e.g. `"type": "AAAA"` or `"type": 28`
+type flexibleString string
+
+func (s *flexibleString) UnmarshalJSON(data []byte) error {
+	if len(data) > 0 && data[0] == '"' {
+		var str string
+		if err := json.Unmarshal(data, &str); err != nil {
+			return err
+		}
+		*s = flexibleString(str)
+		return nil
+	}
+	if string(data) == "null" {
+		*s = ""
+		return nil
+	}
+	*s = flexibleString(data)
+	return nil
+}
+
+func isJSONContentType(contentType string) bool {
+	contentType = strings.TrimSpace(strings.SplitN(contentType, ";", 2)[0])
+	return contentType == constant.ContentTypeApplicationJSON || contentType == constant.ContentTypeApplicationDNSJSON
+}
+
+func isDNSMessageContentType(contentType string) bool {
+	contentType = strings.TrimSpace(strings.SplitN(contentType, ";", 2)[0])
+	return contentType == constant.ContentTypeApplicationDNSMessage || contentType == constant.ContentTypeApplicationUDPWireFormat
+}
+
+func isFormContentType(contentType string) bool {
+	contentType = strings.TrimSpace(strings.SplitN(contentType, ";", 2)[0])
+	return contentType == "application/x-www-form-urlencoded" || contentType == "multipart/form-data"
+}
+
 // Reference https://developers.google.com/speed/public-dns/docs/doh/json
 func ParseGoogleDoHProtocol(r *http.Request) *types.Context {
-	domainName := r.FormValue("name")
-	if domainName == "" {
+	var query GoogleDoHQuery
+	if r.Method == http.MethodPost && isJSONContentType(r.Header.Get("Content-Type")) {
+		if err := json.NewDecoder(io.LimitReader(r.Body, dns.MaxMsgSize)).Decode(&query); err != nil {
+			ctx := types.NewContext(GetClientIPFromRequest(r), new(dns.Msg))
+			ctx.AbortWithErr(fmt.Errorf("invalid JSON body: %w", err))
+			return ctx
+		}
+	} else {
+		query = GoogleDoHQuery{
+			Name:             r.FormValue("name"),
+			Type:             flexibleString(r.FormValue("type")),
+			CD:               flexibleString(r.FormValue("cd")),
+			DO:               flexibleString(r.FormValue("do")),
+			EdnsClientSubnet: r.FormValue("edns_client_subnet"),
+		}
+	}
+	if query.Name == "" {
 		return nil
 	}
+	return NewGoogleDoHContext(GetClientIPFromRequest(r), query, checkDisabledECS(r))
+}
+
+// NewGoogleDoHContext returns context of the Google JSON API query
+func NewGoogleDoHContext(clientIP net.IP, query GoogleDoHQuery, disableECS bool) *types.Context {
 	msg := new(dns.Msg)
-	ctx := types.NewContext(GetClientIPFromRequest(r), msg)
+	ctx := types.NewContext(clientIP, msg)
+	domainName := query.Name
 	if punycode, err := idna.ToASCII(domainName); err == nil {
 		domainName = punycode
 	} else {
@@ -158,7 +376,7 @@ func ParseGoogleDoHProtocol(r *http.Request) *types.Context {
 
 	// Default to A record
 	rrType := dns.TypeA
-	rrTypeStr := r.FormValue("type")
+	rrTypeStr := string(query.Type)
 	if rrTypeStr != "" {
 		// try uint16
 		if rt, err := strconv.ParseUint(rrTypeStr, 10, 16); err == nil {
@@ -173,14 +391,14 @@ func ParseGoogleDoHProtocol(r *http.Request) *types.Context {
 		}
 	}
 
-	cdStr := r.FormValue("cd")
+	cdStr := string(query.CD)
 	checkingDisabled, ok := parseGenericBool(cdStr, false)
 	if !ok {
 		ctx.AbortWithErr(fmt.Errorf("invalid DNSSEC checking disabled(cd): %s", cdStr))
 		return ctx
 	}
 
-	doStr := r.FormValue("do")
+	doStr := string(query.DO)
 	includeDNSSECRecord, ok := parseGenericBool(doStr, false)
 	if !ok {
 		ctx.AbortWithErr(fmt.Errorf("invalid do: %s", doStr))
@@ -194,7 +412,7 @@ func ParseGoogleDoHProtocol(r *http.Request) *types.Context {
 	opt.Hdr.Rrtype = dns.TypeOPT
 	opt.SetUDPSize(dns.DefaultMsgSize)
 	opt.SetDo(includeDNSSECRecord)
-	if !checkDisabledECS(r) {
+	if !disableECS {
 		// ECS
 		var (
 			// Unspecified netmask size set to 256
@@ -202,7 +420,7 @@ func ParseGoogleDoHProtocol(r *http.Request) *types.Context {
 			ednsIPAddress net.IP
 		)
 
-		if ednsClientSubnet := r.FormValue("edns_client_subnet"); ednsClientSubnet == "" {
+		if ednsClientSubnet := query.EdnsClientSubnet; ednsClientSubnet == "" {
 			// Get IP from request
 			if ip := ctx.ClientIP(); ip != nil {
 				ednsIPAddress = ip
@@ -273,10 +491,15 @@ func ParseIETFDoHProtocol(r *http.Request) *types.Context {
 		err        error
 	)
 	rawMessageStr := r.FormValue("dns")
-	if len(rawMessageStr) > 0 {
+	fromBody := len(rawMessageStr) == 0
+	if !fromBody {
 		rawMessage, err = base64.RawURLEncoding.DecodeString(rawMessageStr)
 	} else {
-		rawMessage, err = ioutil.ReadAll(r.Body)
+		if !isDNSMessageContentType(r.Header.Get("Content-Type")) {
+			// Body may be of other protocols
+			return nil
+		}
+		rawMessage, err = ioutil.ReadAll(io.LimitReader(r.Body, dns.MaxMsgSize+1))
 	}
 	if err != nil {
 		ctx.AbortWithErr(fmt.Errorf("invalid request body: %s", err))
@@ -285,6 +508,12 @@ func ParseIETFDoHProtocol(r *http.Request) *types.Context {
 	if len(rawMessage) == 0 {
 		return nil
 	}
+	if fromBody {
+		if len(rawMessage) > dns.MaxMsgSize {
+			ctx.AbortWithErr(errPayloadTooLarge)
+			return ctx
+		}
+	}
 	err = msg.Unpack(rawMessage)
 	if err != nil {
 		ctx.AbortWithErr(fmt.Errorf("invalid request body: %s", err))
@@ -329,25 +558,38 @@ func ParseIETFDoHProtocol(r *http.Request) *types.Context {
 	return ctx
 }
 
-func (e *Endpoint) responseOnJSON(ctx *types.Context, w http.ResponseWriter) {
+func (e *Endpoint) responseOnJSON(ctx *types.Context, w http.ResponseWriter, r *http.Request, contentType string) {
+	structured, ok := parseGenericBool(r.FormValue("structured"), false)
+	if !ok {
+		e.responseError(w, http.StatusBadRequest, fmt.Errorf("invalid structured: %s", r.FormValue("structured")))
+		return
+	}
+	callback := r.FormValue("callback")
+	if contentType == constant.ContentTypeApplicationXJavascript && callback != "" && !jsonpCallbackPattern.MatchString(callback) {
+		e.responseError(w, http.StatusBadRequest, fmt.Errorf("invalid callback: %s", callback))
+		return
+	}
 	if err := ctx.Error(); err != nil {
-		w.Header().Set("Content-Type", constant.ContentTypeApplicationJSON)
-		w.Write([]byte(`{"error":"` + err.Error() + `"}`))
-		w.WriteHeader(http.StatusBadRequest)
+		e.responseError(w, http.StatusBadGateway, err)
 		return
 	}
 	resp := ctx.GetResponse()
 	if resp == nil {
-		w.Header().Set("Content-Type", constant.ContentTypeApplicationJSON)
-		w.Write([]byte(`{"error":"internal error"}`))
-		w.WriteHeader(http.StatusInternalServerError)
+		e.responseError(w, http.StatusBadGateway, errors.New("no response from upstream"))
 		return
 	}
-	payload, err := json.Marshal(ParseDNSResponseFromMessage(resp))
+	payload, err := json.Marshal(ParseDNSResponseFromMessage(resp, structured))
 	if err != nil {
-		w.Header().Set("Content-Type", constant.ContentTypeApplicationJSON)
-		w.Write([]byte(`{"error":"` + err.Error() + `"}`))
-		w.WriteHeader(http.StatusInternalServerError)
+		e.responseError(w, http.StatusInternalServerError, err)
+		return
+	}
+	setCacheControl(w, resp)
+	if contentType == constant.ContentTypeApplicationXJavascript && callback != "" {
+		// JSONP
+		w.Header().Set("Content-Type", constant.ContentTypeApplicationXJavascript)
+		w.Write([]byte(callback + "("))
+		w.Write(payload)
+		w.Write([]byte(");"))
 		return
 	}
 	w.Header().Set("Content-Type", constant.ContentTypeApplicationJSON)
@@ -355,30 +597,46 @@ func (e *Endpoint) responseOnJSON(ctx *types.Context, w http.ResponseWriter) {
 }
 
 func (e *Endpoint) responseOnDNSMsg(ctx *types.Context, w http.ResponseWriter) {
-	if err := ctx.Error(); err != nil {
-		w.Header().Set("Content-Type", constant.ContentTypeApplicationJSON)
-		w.Write([]byte(`{"error":"` + err.Error() + `"}`))
-		w.WriteHeader(http.StatusBadRequest)
-		return
-	}
-	resp := ctx.GetResponse()
-	if resp == nil {
-		w.Header().Set("Content-Type", constant.ContentTypeApplicationJSON)
-		w.Write([]byte(`{"error":"internal error"}`))
-		w.WriteHeader(http.StatusInternalServerError)
-		return
-	}
+	// Failures are answered with SERVFAIL or REFUSED in DNS message
+	resp := dnsutil.Reply(ctx)
 	result, err := resp.Pack()
 	if err != nil {
-		w.Header().Set("Content-Type", constant.ContentTypeApplicationJSON)
-		w.Write([]byte(`{"error":"` + err.Error() + `"}`))
-		w.WriteHeader(http.StatusBadRequest)
+		e.responseError(w, http.StatusInternalServerError, err)
 		return
 	}
+	if ctx.Error() == nil {
+		setCacheControl(w, resp)
+	}
 	w.Header().Set("Content-Type", constant.ContentTypeApplicationDNSMessage)
 	_, _ = w.Write(result)
 }
 
+func (e *Endpoint) responseError(w http.ResponseWriter, statusCode int, err error) {
+	payload, _ := json.Marshal(map[string]string{"error": err.Error()})
+	w.Header().Set("Content-Type", constant.ContentTypeApplicationJSON)
+	w.WriteHeader(statusCode)
+	_, _ = w.Write(payload)
+}
+
+// setCacheControl sets freshness lifetime to the minimum TTL of response as RFC 8484 section 5.1 described
+func setCacheControl(w http.ResponseWriter, resp *dns.Msg) {
+	if ttl, ok := dnsutil.MinTTL(resp); ok {
+		w.Header().Set("Cache-Control", "max-age="+strconv.FormatUint(uint64(ttl), 10))
+	}
+}
+
+// statusOfRequestError returns the HTTP status code of the error occurred on parsing request
+func statusOfRequestError(err error) int {
+	switch {
+	case errors.Is(err, errPayloadTooLarge):
+		return http.StatusRequestEntityTooLarge
+	case errors.Is(err, errUnsupportedMediaType):
+		return http.StatusUnsupportedMediaType
+	default:
+		return http.StatusBadRequest
+	}
+}
+
 func parseGenericBool(raw string, defaultValue bool) (result, ok bool) {
 	switch raw {
 	case "":
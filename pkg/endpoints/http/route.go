@@ -0,0 +1,81 @@
+package http
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/blho/apexdns/pkg/types"
+)
+
+const (
+	// ProtocolIETF is the RFC 8484 DNS wire format protocol
+	ProtocolIETF = "ietf"
+	// ProtocolJSON is the Google(also Cloudflare compatible) JSON API protocol
+	ProtocolJSON = "json"
+	// ProtocolBatch resolves a list of JSON API queries in one request
+	ProtocolBatch = "batch"
+)
+
+var protocolParsers = map[string]func(*http.Request) *types.Context{
+	ProtocolIETF: ParseIETFDoHProtocol,
+	ProtocolJSON: ParseGoogleDoHProtocol,
+}
+
+// DefaultRoutes used when no route configured
+func DefaultRoutes() map[string][]string {
+	return map[string][]string{
+		"/dns-query": {ProtocolJSON, ProtocolIETF},
+		"/resolve":   {ProtocolJSON},
+	}
+}
+
+func validateRoute(path string, protocols []string) error {
+	if len(path) == 0 || path[0] != '/' {
+		return fmt.Errorf("invalid route path: %s", path)
+	}
+	if len(protocols) == 0 {
+		return fmt.Errorf("no protocol specified for route: %s", path)
+	}
+	for _, protocol := range protocols {
+		if protocol == ProtocolBatch {
+			if len(protocols) > 1 {
+				return fmt.Errorf("batch protocol can't be mixed with others for route: %s", path)
+			}
+			continue
+		}
+		if _, ok := protocolParsers[protocol]; !ok {
+			return fmt.Errorf("unknown protocol %s for route: %s", protocol, path)
+		}
+	}
+	return nil
+}
+
+// parseContextByProtocols returns the context parsed by the first matched protocol, nil if mismatch
+func parseContextByProtocols(r *http.Request, protocols []string) (*types.Context, string) {
+	for _, protocol := range protocols {
+		if ctx := protocolParsers[protocol](r); ctx != nil {
+			return ctx, protocol
+		}
+	}
+	return nil, ""
+}
+
+// acceptsMediaType reports whether request body in contentType is accepted by any of protocols
+func acceptsMediaType(protocols []string, contentType string) bool {
+	if contentType == "" {
+		return true
+	}
+	for _, protocol := range protocols {
+		switch protocol {
+		case ProtocolIETF:
+			if isDNSMessageContentType(contentType) {
+				return true
+			}
+		case ProtocolJSON:
+			if isJSONContentType(contentType) || isFormContentType(contentType) {
+				return true
+			}
+		}
+	}
+	return false
+}
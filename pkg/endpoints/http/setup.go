@@ -3,9 +3,12 @@ package http
 import (
 	"errors"
 	"fmt"
+	"strconv"
 
 	"github.com/blho/apexdns/pkg/server"
 	"github.com/blho/apexdns/pkg/types"
+	"github.com/blho/apexdns/pkg/utils/netutil"
+	"github.com/blho/apexdns/pkg/utils/proxyprotocol"
 )
 
 const (
@@ -43,5 +46,90 @@ func parse(c types.EndpointConfig) (endpoint types.Endpoint, err error) {
 	default:
 		return nil, fmt.Errorf("invalid HTTP endpoint arguments: %v", args)
 	}
-	return New(listenAddr, certFile, keyFile, c.Handler)
+	var opts Options
+	for c.NextBlock() {
+		switch key := c.Val(); key {
+		case "http3", "h2c":
+			args := c.RemainingArgs()
+			if len(args) != 1 || (args[0] != "on" && args[0] != "off") {
+				return nil, fmt.Errorf("invalid %s arguments: %v", key, args)
+			}
+			if key == "http3" {
+				opts.HTTP3 = args[0] == "on"
+			} else {
+				opts.H2C = args[0] == "on"
+			}
+		case "route":
+			// route <path> <protocol>...
+			args := c.RemainingArgs()
+			if len(args) < 2 {
+				return nil, fmt.Errorf("invalid route arguments: %v", args)
+			}
+			if err := validateRoute(args[0], args[1:]); err != nil {
+				return nil, err
+			}
+			if opts.Routes == nil {
+				opts.Routes = make(map[string][]string)
+			}
+			opts.Routes[args[0]] = args[1:]
+		case "trusted_proxies":
+			args := c.RemainingArgs()
+			if len(args) == 0 {
+				return nil, errors.New("trusted_proxies requires at least one CIDR")
+			}
+			proxies, err := netutil.ParseCIDRs(args)
+			if err != nil {
+				return nil, err
+			}
+			opts.TrustedProxies = append(opts.TrustedProxies, proxies...)
+		case "proxy_protocol":
+			allowed, err := proxyprotocol.ParseAllowed(c.RemainingArgs())
+			if err != nil {
+				return nil, err
+			}
+			opts.ProxyProtocol = append(opts.ProxyProtocol, allowed...)
+		case "batch_concurrency":
+			args := c.RemainingArgs()
+			if len(args) != 1 {
+				return nil, fmt.Errorf("invalid batch_concurrency arguments: %v", args)
+			}
+			concurrency, err := strconv.Atoi(args[0])
+			if err != nil {
+				return nil, err
+			}
+			opts.BatchConcurrency = concurrency
+		case "batch_max_items":
+			args := c.RemainingArgs()
+			if len(args) != 1 {
+				return nil, fmt.Errorf("invalid batch_max_items arguments: %v", args)
+			}
+			maxItems, err := strconv.Atoi(args[0])
+			if err != nil || maxItems <= 0 {
+				return nil, fmt.Errorf("invalid batch_max_items: %s", args[0])
+			}
+			opts.BatchMaxItems = maxItems
+		case "client_ca":
+			args := c.RemainingArgs()
+			if len(args) != 1 {
+				return nil, fmt.Errorf("invalid client_ca arguments: %v", args)
+			}
+			opts.ClientCA = args[0]
+		case "auth_token":
+			// auth_token <client identity> <token>
+			args := c.RemainingArgs()
+			if len(args) != 2 {
+				return nil, fmt.Errorf("invalid auth_token arguments: %v", args)
+			}
+			if opts.AuthTokens == nil {
+				opts.AuthTokens = make(map[string]string)
+			}
+			if _, duplicated := opts.AuthTokens[args[1]]; duplicated {
+				return nil, fmt.Errorf("duplicated auth token of client: %s", args[0])
+			}
+			opts.AuthTokens[args[1]] = args[0]
+		default:
+			return nil, fmt.Errorf("unknown config in HTTP endpoint: %s %v", key, c.RemainingArgs())
+		}
+	}
+	return New(listenAddr, certFile, keyFile, opts, c.Handler)
 }
@@ -1,35 +1,122 @@
 package http
 
 import (
+	"context"
 	"net"
 	"net/http"
 	"strings"
+
+	"github.com/blho/apexdns/pkg/utils/netutil"
 )
 
+type clientIPContextKey struct{}
+
+// GetClientIPFromRequest returns the client IP resolved by endpoint, or the remote address
+// of request if unresolved
 func GetClientIPFromRequest(r *http.Request) net.IP {
-	for _, IPFn := range []func() string{
-		func() string {
-			if XForwardedFor := r.Header.Get("X-Forwarded-For"); XForwardedFor != "" {
-				return strings.SplitN(XForwardedFor, ",", 1)[0]
-			}
-			return ""
-		},
-		func() string {
-			return r.Header.Get("X-Real-IP")
-		},
-		func() string {
-			portIndex := strings.IndexByte(r.RemoteAddr, ':')
-			if portIndex > 0 {
-				return r.RemoteAddr[:portIndex]
+	if ip, ok := r.Context().Value(clientIPContextKey{}).(net.IP); ok {
+		return ip
+	}
+	return getRemoteIP(r)
+}
+
+func withClientIP(r *http.Request, ip net.IP) *http.Request {
+	return r.WithContext(context.WithValue(r.Context(), clientIPContextKey{}, ip))
+}
+
+func getRemoteIP(r *http.Request) net.IP {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	return net.ParseIP(host)
+}
+
+// ClientIPResolver resolves client IP from request, forwarding headers are only
+// respected if request comes from trusted proxies
+type ClientIPResolver struct {
+	trustedProxies []*net.IPNet
+}
+
+func NewClientIPResolver(trustedProxies []*net.IPNet) *ClientIPResolver {
+	return &ClientIPResolver{
+		trustedProxies: trustedProxies,
+	}
+}
+
+func (c *ClientIPResolver) isTrusted(ip net.IP) bool {
+	return netutil.ContainsIP(c.trustedProxies, ip)
+}
+
+// Resolve walks the forwarding chain from right to left, and returns the first address
+// which is not a trusted proxy
+func (c *ClientIPResolver) Resolve(r *http.Request) net.IP {
+	clientIP := getRemoteIP(r)
+	if clientIP == nil || !c.isTrusted(clientIP) {
+		return clientIP
+	}
+	chain := parseForwarded(r.Header.Values("Forwarded"))
+	if len(chain) == 0 {
+		chain = parseXForwardedFor(r.Header.Values("X-Forwarded-For"))
+	}
+	if len(chain) == 0 {
+		if XRealIP := r.Header.Get("X-Real-IP"); XRealIP != "" {
+			chain = []string{XRealIP}
+		}
+	}
+	for i := len(chain) - 1; i >= 0; i-- {
+		ip := net.ParseIP(chain[i])
+		if ip == nil {
+			// Unable to go further with broken chain
+			break
+		}
+		clientIP = ip
+		if !c.isTrusted(ip) {
+			break
+		}
+	}
+	return clientIP
+}
+
+func parseXForwardedFor(values []string) []string {
+	var chain []string
+	for _, value := range values {
+		for _, addr := range strings.Split(value, ",") {
+			chain = append(chain, strings.TrimSpace(addr))
+		}
+	}
+	return chain
+}
+
+// parseForwarded parses `for` parameters in RFC 7239 Forwarded header,
+// e.g. `for=192.0.2.60;proto=http, for="[2001:db8:cafe::17]:4711"`
+func parseForwarded(values []string) []string {
+	var chain []string
+	for _, value := range values {
+		for _, element := range strings.Split(value, ",") {
+			for _, pair := range strings.Split(element, ";") {
+				kv := strings.SplitN(strings.TrimSpace(pair), "=", 2)
+				if len(kv) != 2 || !strings.EqualFold(kv[0], "for") {
+					continue
+				}
+				chain = append(chain, parseForwardedNode(strings.Trim(kv[1], `"`)))
 			}
-			return r.RemoteAddr
-		},
-	} {
-		IPStr := IPFn()
-		if IPStr == "" {
-			continue
 		}
-		return net.ParseIP(strings.TrimSpace(IPStr))
 	}
-	return nil
+	return chain
+}
+
+// parseForwardedNode strips port from node, obfuscated and unknown nodes returned as is
+func parseForwardedNode(node string) string {
+	if strings.HasPrefix(node, "[") {
+		// IPv6 with optional port
+		if end := strings.IndexByte(node, ']'); end > 0 {
+			return node[1:end]
+		}
+		return node
+	}
+	if host, _, err := net.SplitHostPort(node); err == nil {
+		return host
+	}
+	return node
 }
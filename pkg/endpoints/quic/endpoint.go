@@ -0,0 +1,189 @@
+package quic
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/blho/apexdns/pkg/types"
+	"github.com/blho/apexdns/pkg/utils/dnsutil"
+	"github.com/blho/apexdns/pkg/utils/tlsutil"
+
+	"github.com/miekg/dns"
+	"github.com/quic-go/quic-go"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// ALPN of DNS over QUIC
+	ALPN = "doq"
+
+	// Error codes defined in RFC 9250 section 4.3
+	doqInternalError = quic.ApplicationErrorCode(0x1)
+	doqProtocolError = quic.ApplicationErrorCode(0x2)
+
+	streamReadTimeout = 5 * time.Second
+)
+
+// Options of QUIC endpoint
+type Options struct {
+	// Allow0RTT accepts queries in 0-RTT data
+	Allow0RTT bool
+	// MaxStreams limits concurrent streams per connection
+	MaxStreams int64
+	// IdleTimeout closes the connection if no activity within it
+	IdleTimeout time.Duration
+}
+
+func NewDefaultOptions() Options {
+	return Options{
+		Allow0RTT:   false,
+		MaxStreams:  100,
+		IdleTimeout: 30 * time.Second,
+	}
+}
+
+// Endpoint serves RFC 9250 DNS over QUIC, each stream carries a single query
+type Endpoint struct {
+	listenAddress string
+	tlsConfig     *tls.Config
+	quicConfig    *quic.Config
+	listenerLock  sync.Mutex
+	listener      *quic.EarlyListener
+	stopCh        chan struct{}
+	handler       types.ContextHandler
+	logger        *logrus.Entry
+}
+
+func New(listenAddress string, tlsConfig *tls.Config, opts Options, handler types.ContextHandler, logger *logrus.Entry) (*Endpoint, error) {
+	e := &Endpoint{
+		listenAddress: listenAddress,
+		tlsConfig:     tlsConfig,
+		quicConfig: &quic.Config{
+			Allow0RTT:          opts.Allow0RTT,
+			MaxIncomingStreams: opts.MaxStreams,
+			MaxIdleTimeout:     opts.IdleTimeout,
+		},
+		stopCh:  make(chan struct{}),
+		handler: handler,
+		logger:  logger,
+	}
+	return e, nil
+}
+
+func (e *Endpoint) Run() error {
+	listener, err := quic.ListenAddrEarly(e.listenAddress, e.tlsConfig, e.quicConfig)
+	if err != nil {
+		return err
+	}
+	e.listenerLock.Lock()
+	select {
+	case <-e.stopCh:
+		// Closed before listening
+		e.listenerLock.Unlock()
+		return listener.Close()
+	default:
+	}
+	e.listener = listener
+	e.listenerLock.Unlock()
+	e.logger.Infof("Listening on %s", listener.Addr())
+	for {
+		conn, err := listener.Accept(context.Background())
+		if err != nil {
+			select {
+			case <-e.stopCh:
+				return nil
+			default:
+			}
+			return err
+		}
+		go e.serveConn(conn)
+	}
+}
+
+func (e *Endpoint) serveConn(conn *quic.Conn) {
+	var (
+		clientIP = getClientIP(conn.RemoteAddr())
+		identity string
+	)
+	if e.tlsConfig.ClientCAs != nil {
+		// Client certificate is only available after handshake, which disables 0-RTT
+		select {
+		case <-conn.HandshakeComplete():
+		case <-conn.Context().Done():
+			return
+		}
+		identity = tlsutil.PeerIdentity(conn.ConnectionState().TLS)
+	}
+	for {
+		stream, err := conn.AcceptStream(context.Background())
+		if err != nil {
+			// Connection closed by peer or idle timeout
+			return
+		}
+		go e.serveStream(conn, stream, clientIP, identity)
+	}
+}
+
+func (e *Endpoint) serveStream(conn *quic.Conn, stream *quic.Stream, clientIP net.IP, identity string) {
+	defer stream.Close()
+	stream.SetReadDeadline(time.Now().Add(streamReadTimeout))
+	var length [2]byte
+	if _, err := io.ReadFull(stream, length[:]); err != nil {
+		stream.CancelRead(quic.StreamErrorCode(doqProtocolError))
+		return
+	}
+	raw := make([]byte, binary.BigEndian.Uint16(length[:]))
+	if _, err := io.ReadFull(stream, raw); err != nil {
+		stream.CancelRead(quic.StreamErrorCode(doqProtocolError))
+		return
+	}
+	query := new(dns.Msg)
+	// Message ID must be zero in DoQ
+	if err := query.Unpack(raw); err != nil || query.Id != 0 {
+		conn.CloseWithError(doqProtocolError, "invalid query")
+		return
+	}
+	var resp *dns.Msg
+	if len(query.Question) == 0 {
+		resp = new(dns.Msg).SetRcodeFormatError(query)
+	} else {
+		ctx := types.NewContext(clientIP, query)
+		ctx.SetClientIdentity(identity)
+		e.handler(ctx)
+		resp = dnsutil.Reply(ctx)
+	}
+	payload, err := resp.Pack()
+	if err != nil {
+		e.logger.WithError(err).Error("Unable to pack response")
+		stream.CancelWrite(quic.StreamErrorCode(doqInternalError))
+		return
+	}
+	buf := make([]byte, 2+len(payload))
+	binary.BigEndian.PutUint16(buf, uint16(len(payload)))
+	copy(buf[2:], payload)
+	if _, err = stream.Write(buf); err != nil {
+		e.logger.WithError(err).Warnf("Unable to write response to %s", conn.RemoteAddr())
+	}
+}
+
+func (e *Endpoint) Close() error {
+	e.listenerLock.Lock()
+	defer e.listenerLock.Unlock()
+	close(e.stopCh)
+	if e.listener == nil {
+		return nil
+	}
+	return e.listener.Close()
+}
+
+func getClientIP(addr net.Addr) net.IP {
+	if udpAddr, ok := addr.(*net.UDPAddr); ok {
+		return udpAddr.IP
+	}
+	return nil
+}
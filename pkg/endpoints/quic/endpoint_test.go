@@ -0,0 +1,304 @@
+package quic
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/binary"
+	"encoding/pem"
+	"errors"
+	"io"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/blho/apexdns/pkg/types"
+	"github.com/blho/apexdns/pkg/utils/tlsutil"
+
+	"github.com/caddyserver/caddy/caddyfile"
+	"github.com/miekg/dns"
+	"github.com/quic-go/quic-go"
+	"github.com/sirupsen/logrus"
+)
+
+// writeSelfSignedCert writes a certificate of 127.0.0.1 and its key to dir
+func writeSelfSignedCert(t *testing.T, dir string) (certFile, keyFile string) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "apexdns test"},
+		IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1)},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certFile, keyFile = filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	if err = os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err = os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return certFile, keyFile
+}
+
+// freeUDPAddr returns a loopback address which is not in use
+func freeUDPAddr(t *testing.T) string {
+	t.Helper()
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	return conn.LocalAddr().String()
+}
+
+// startTestEndpoint runs endpoint on loopback, it returns the address and client TLS config
+func startTestEndpoint(t *testing.T, opts Options, handler types.ContextHandler) (string, *tls.Config) {
+	t.Helper()
+	certFile, keyFile := writeSelfSignedCert(t, t.TempDir())
+	tlsConfig, err := tlsutil.NewServerConfig(certFile, keyFile, ALPN)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tlsConfig.MinVersion = tls.VersionTLS13
+	addr := freeUDPAddr(t)
+	logger := logrus.New()
+	logger.SetOutput(io.Discard)
+	e, err := New(addr, tlsConfig, opts, handler, logrus.NewEntry(logger))
+	if err != nil {
+		t.Fatal(err)
+	}
+	go e.Run()
+	t.Cleanup(func() {
+		e.Close()
+	})
+
+	certPEM, err := os.ReadFile(certFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	roots := x509.NewCertPool()
+	roots.AppendCertsFromPEM(certPEM)
+	return addr, &tls.Config{RootCAs: roots, NextProtos: []string{ALPN}, MinVersion: tls.VersionTLS13}
+}
+
+func dialTestEndpoint(t *testing.T, addr string, tlsConfig *tls.Config) *quic.Conn {
+	t.Helper()
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	var (
+		conn *quic.Conn
+		err  error
+	)
+	// Endpoint may be not listening yet
+	for {
+		if conn, err = quic.DialAddr(ctx, addr, tlsConfig, nil); err == nil || ctx.Err() != nil {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		conn.CloseWithError(0, "")
+	})
+	return conn
+}
+
+func writeQuery(t *testing.T, stream *quic.Stream, query *dns.Msg) {
+	t.Helper()
+	raw, err := query.Pack()
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 2+len(raw))
+	binary.BigEndian.PutUint16(buf, uint16(len(raw)))
+	copy(buf[2:], raw)
+	if _, err = stream.Write(buf); err != nil {
+		t.Fatal(err)
+	}
+	stream.Close()
+}
+
+func readResponse(stream *quic.Stream) (*dns.Msg, error) {
+	stream.SetReadDeadline(time.Now().Add(2 * time.Second))
+	var length [2]byte
+	if _, err := io.ReadFull(stream, length[:]); err != nil {
+		return nil, err
+	}
+	raw := make([]byte, binary.BigEndian.Uint16(length[:]))
+	if _, err := io.ReadFull(stream, raw); err != nil {
+		return nil, err
+	}
+	response := new(dns.Msg)
+	return response, response.Unpack(raw)
+}
+
+func answerHandler(ctx *types.Context) {
+	response := new(dns.Msg)
+	response.SetReply(ctx.GetQueryMessage())
+	rr, _ := dns.NewRR(ctx.GetQueryMessage().Question[0].Name + " 60 IN A 10.0.0.1")
+	response.Answer = append(response.Answer, rr)
+	ctx.SetResponse(response)
+}
+
+func TestEndpointStreamToContext(t *testing.T) {
+	contexts := make(chan *types.Context, 2)
+	addr, tlsConfig := startTestEndpoint(t, NewDefaultOptions(), func(ctx *types.Context) {
+		contexts <- ctx
+		answerHandler(ctx)
+	})
+	conn := dialTestEndpoint(t, addr, tlsConfig)
+
+	// Each stream carries a query
+	for _, name := range []string{"a.example.com.", "b.example.com."} {
+		stream, err := conn.OpenStreamSync(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+		query := new(dns.Msg)
+		query.SetQuestion(name, dns.TypeA)
+		query.Id = 0
+		writeQuery(t, stream, query)
+		response, err := readResponse(stream)
+		if err != nil {
+			t.Fatalf("unable to read response of %s: %v", name, err)
+		}
+		if response.Id != 0 || len(response.Answer) != 1 || response.Answer[0].Header().Name != name {
+			t.Errorf("unexpected response of %s: %v", name, response)
+		}
+		ctx := <-contexts
+		if got := ctx.GetQueryMessage().Question[0].Name; got != name {
+			t.Errorf("expect query %s in context, got %s", name, got)
+		}
+		if !ctx.ClientIP().Equal(net.IPv4(127, 0, 0, 1)) {
+			t.Errorf("expect client IP 127.0.0.1, got %s", ctx.ClientIP())
+		}
+	}
+}
+
+func TestEndpointRejectNonZeroID(t *testing.T) {
+	addr, tlsConfig := startTestEndpoint(t, NewDefaultOptions(), answerHandler)
+	conn := dialTestEndpoint(t, addr, tlsConfig)
+
+	stream, err := conn.OpenStreamSync(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	query := new(dns.Msg)
+	query.SetQuestion("example.com.", dns.TypeA)
+	query.Id = 1234
+	writeQuery(t, stream, query)
+
+	select {
+	case <-conn.Context().Done():
+	case <-time.After(2 * time.Second):
+		t.Fatal("connection is not closed")
+	}
+	var appErr *quic.ApplicationError
+	if err = context.Cause(conn.Context()); !errors.As(err, &appErr) {
+		t.Fatalf("expect application error, got %v", err)
+	}
+	if !appErr.Remote || appErr.ErrorCode != doqProtocolError {
+		t.Errorf("expect DOQ_PROTOCOL_ERROR from endpoint, got %v", appErr)
+	}
+}
+
+func TestEndpointMaxStreams(t *testing.T) {
+	const maxStreams = 2
+	release := make(chan struct{})
+	opts := NewDefaultOptions()
+	opts.MaxStreams = maxStreams
+	addr, tlsConfig := startTestEndpoint(t, opts, func(ctx *types.Context) {
+		<-release
+		answerHandler(ctx)
+	})
+	conn := dialTestEndpoint(t, addr, tlsConfig)
+
+	query := new(dns.Msg)
+	query.SetQuestion("example.com.", dns.TypeA)
+	query.Id = 0
+	var streams []*quic.Stream
+	for i := 0; i < maxStreams; i++ {
+		stream, err := conn.OpenStream()
+		if err != nil {
+			t.Fatalf("unable to open stream %d: %v", i, err)
+		}
+		writeQuery(t, stream, query)
+		streams = append(streams, stream)
+	}
+	var limitErr *quic.StreamLimitReachedError
+	if _, err := conn.OpenStream(); !errors.As(err, &limitErr) {
+		t.Fatalf("expect stream limit reached, got %v", err)
+	}
+
+	// Streams are allowed again once the previous ones are done
+	close(release)
+	for _, stream := range streams {
+		if _, err := readResponse(stream); err != nil {
+			t.Fatal(err)
+		}
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	stream, err := conn.OpenStreamSync(ctx)
+	if err != nil {
+		t.Fatalf("unable to open stream after previous ones are done: %v", err)
+	}
+	writeQuery(t, stream, query)
+	if _, err = readResponse(stream); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestParseMaxStreams(t *testing.T) {
+	certFile, keyFile := writeSelfSignedCert(t, t.TempDir())
+	for _, c := range []struct {
+		value string
+		valid bool
+	}{
+		{"1", true},
+		{"100", true},
+		{"0", false},
+		{"-1", false},
+		{"many", false},
+	} {
+		config := "quic 127.0.0.1:853 " + certFile + " " + keyFile + " {\n max_streams " + c.value + "\n}"
+		endpoint, err := parse(types.EndpointConfig{
+			Logger:    logrus.NewEntry(logrus.New()),
+			Dispenser: caddyfile.NewDispenser("test", strings.NewReader(config)),
+			Handler:   answerHandler,
+		})
+		if c.valid != (err == nil) {
+			t.Errorf("max_streams %s: expect valid %v, got error %v", c.value, c.valid, err)
+			continue
+		}
+		if c.valid {
+			if got := endpoint.(*Endpoint).quicConfig.MaxIncomingStreams; strconv.FormatInt(got, 10) != c.value {
+				t.Errorf("expect max_streams %s, got %d", c.value, got)
+			}
+		}
+	}
+}
@@ -0,0 +1,88 @@
+package quic
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/blho/apexdns/pkg/server"
+	"github.com/blho/apexdns/pkg/types"
+	"github.com/blho/apexdns/pkg/utils/tlsutil"
+)
+
+const (
+	Name = "quic"
+)
+
+func init() {
+	server.RegisterEndpoint(types.EndpointInitializer{
+		Name:        Name,
+		Description: "DNS over QUIC resolver endpoint",
+		SetupFunc: func(config types.EndpointConfig) (types.Endpoint, error) {
+			return parse(config)
+		},
+	})
+}
+
+func parse(c types.EndpointConfig) (endpoint types.Endpoint, err error) {
+	if !c.Next() {
+		return nil, errors.New("invalid QUIC endpoint config")
+	}
+	// args listenAddr certFile keyFile
+	args := c.RemainingArgs()
+	if len(args) != 3 {
+		return nil, fmt.Errorf("invalid QUIC endpoint arguments: %v", args)
+	}
+	tlsConfig, err := tlsutil.NewServerConfig(args[1], args[2], ALPN)
+	if err != nil {
+		return nil, err
+	}
+	// QUIC requires TLS 1.3
+	tlsConfig.MinVersion = tls.VersionTLS13
+	opts := NewDefaultOptions()
+	for c.NextBlock() {
+		switch key := c.Val(); key {
+		case "allow_0rtt":
+			args := c.RemainingArgs()
+			if len(args) != 1 || (args[0] != "on" && args[0] != "off") {
+				return nil, fmt.Errorf("invalid allow_0rtt arguments: %v", args)
+			}
+			opts.Allow0RTT = args[0] == "on"
+		case "max_streams":
+			args := c.RemainingArgs()
+			if len(args) != 1 {
+				return nil, fmt.Errorf("invalid max_streams arguments: %v", args)
+			}
+			// Zero and negative values have special meanings in QUIC config
+			maxStreams, err := strconv.ParseInt(args[0], 10, 64)
+			if err != nil || maxStreams <= 0 {
+				return nil, fmt.Errorf("invalid max_streams: %s", args[0])
+			}
+			opts.MaxStreams = maxStreams
+		case "idle_timeout":
+			args := c.RemainingArgs()
+			if len(args) != 1 {
+				return nil, fmt.Errorf("invalid idle_timeout arguments: %v", args)
+			}
+			timeout, err := time.ParseDuration(args[0])
+			if err != nil {
+				return nil, err
+			}
+			opts.IdleTimeout = timeout
+		case "client_ca":
+			// Require client certificate signed by CA
+			args := c.RemainingArgs()
+			if len(args) != 1 {
+				return nil, fmt.Errorf("invalid client_ca arguments: %v", args)
+			}
+			if err := tlsutil.SetClientCA(tlsConfig, args[0], true); err != nil {
+				return nil, err
+			}
+		default:
+			return nil, fmt.Errorf("unknown config in QUIC endpoint: %s %v", key, c.RemainingArgs())
+		}
+	}
+	return New(args[0], tlsConfig, opts, c.Handler, c.Logger)
+}
@@ -2,4 +2,8 @@ package endpoints
 
 import (
 	_ "github.com/blho/apexdns/pkg/endpoints/http"
+	_ "github.com/blho/apexdns/pkg/endpoints/quic"
+	_ "github.com/blho/apexdns/pkg/endpoints/tcp"
+	_ "github.com/blho/apexdns/pkg/endpoints/tls"
+	_ "github.com/blho/apexdns/pkg/endpoints/udp"
 )
@@ -0,0 +1,243 @@
+package tcp
+
+import (
+	"crypto/tls"
+	"encoding/binary"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/blho/apexdns/pkg/types"
+	"github.com/blho/apexdns/pkg/utils/dnsutil"
+	"github.com/blho/apexdns/pkg/utils/netutil"
+	"github.com/blho/apexdns/pkg/utils/proxyprotocol"
+	"github.com/blho/apexdns/pkg/utils/tlsutil"
+
+	"github.com/miekg/dns"
+	"github.com/sirupsen/logrus"
+)
+
+// Options of stream endpoint
+type Options struct {
+	// IdleTimeout closes the connection if no query received within it
+	IdleTimeout time.Duration
+	// ReadTimeout limits the time to read or write a single message
+	ReadTimeout time.Duration
+	// MaxConnections limits concurrent connections per listener, zero means unlimited
+	MaxConnections int
+	// ProxyProtocol lists balancers which allowed to send PROXY protocol header
+	ProxyProtocol []*net.IPNet
+}
+
+func NewDefaultOptions() Options {
+	return Options{
+		IdleTimeout:    10 * time.Second,
+		ReadTimeout:    2 * time.Second,
+		MaxConnections: 1024,
+	}
+}
+
+// Endpoint serves RFC 7766 length-prefixed DNS messages on stream connections
+type Endpoint struct {
+	listenAddress string
+	opts          Options
+	listenerLock  sync.Mutex
+	listener      net.Listener
+	connSem       chan struct{}
+	stopCh        chan struct{}
+	handler       types.ContextHandler
+	logger        *logrus.Entry
+}
+
+func New(listenAddress string, opts Options, handler types.ContextHandler, logger *logrus.Entry) (*Endpoint, error) {
+	e := &Endpoint{
+		listenAddress: listenAddress,
+		opts:          opts,
+		stopCh:        make(chan struct{}),
+		handler:       handler,
+		logger:        logger,
+	}
+	if opts.MaxConnections > 0 {
+		e.connSem = make(chan struct{}, opts.MaxConnections)
+	}
+	return e, nil
+}
+
+// Listen announces on the listen address, PROXY protocol header will be handled if enabled
+func (e *Endpoint) Listen() (net.Listener, error) {
+	listener, err := net.Listen("tcp", e.listenAddress)
+	if err != nil {
+		return nil, err
+	}
+	if len(e.opts.ProxyProtocol) > 0 {
+		listener = proxyprotocol.NewListener(listener, e.opts.ProxyProtocol)
+	}
+	return listener, nil
+}
+
+func (e *Endpoint) Run() error {
+	listener, err := e.Listen()
+	if err != nil {
+		return err
+	}
+	return e.Serve(listener)
+}
+
+// Serve accepts connections on the listener and serves DNS queries on them
+func (e *Endpoint) Serve(listener net.Listener) error {
+	e.listenerLock.Lock()
+	select {
+	case <-e.stopCh:
+		// Closed before listening
+		e.listenerLock.Unlock()
+		return listener.Close()
+	default:
+	}
+	e.listener = listener
+	e.listenerLock.Unlock()
+	e.logger.Infof("Listening on %s", listener.Addr())
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			select {
+			case <-e.stopCh:
+				return nil
+			default:
+			}
+			if netErr, ok := err.(net.Error); ok && netErr.Temporary() {
+				continue
+			}
+			return err
+		}
+		if !e.acquireConn() {
+			e.logger.Debugf("Too many connections, reject %s", conn.RemoteAddr())
+			conn.Close()
+			continue
+		}
+		go func() {
+			defer e.releaseConn()
+			e.serveConn(conn)
+		}()
+	}
+}
+
+func (e *Endpoint) acquireConn() bool {
+	if e.connSem == nil {
+		return true
+	}
+	select {
+	case e.connSem <- struct{}{}:
+		return true
+	default:
+		return false
+	}
+}
+
+func (e *Endpoint) releaseConn() {
+	if e.connSem != nil {
+		<-e.connSem
+	}
+}
+
+func (e *Endpoint) serveConn(conn net.Conn) {
+	var (
+		wg        sync.WaitGroup
+		writeLock sync.Mutex
+		clientIP  = netutil.IPFromAddr(conn.RemoteAddr())
+		identity  string
+	)
+	defer func() {
+		// Wait for pipelined queries before closing connection
+		wg.Wait()
+		conn.Close()
+	}()
+	for {
+		raw, err := e.readMsg(conn)
+		if err != nil {
+			if err != io.EOF {
+				e.logger.WithError(err).Debugf("Closing connection from %s", conn.RemoteAddr())
+			}
+			return
+		}
+		query := new(dns.Msg)
+		if err = query.Unpack(raw); err != nil {
+			e.logger.WithError(err).Debugf("Unable to unpack query from %s", conn.RemoteAddr())
+			return
+		}
+		if tlsConn, ok := conn.(*tls.Conn); ok && identity == "" {
+			// Handshake completed after the first read
+			identity = tlsutil.PeerIdentity(tlsConn.ConnectionState())
+		}
+		wg.Add(1)
+		// Queries are handled concurrently and answered as soon as they are ready
+		go func(identity string) {
+			defer wg.Done()
+			payload, err := e.handleQuery(clientIP, identity, query).Pack()
+			if err != nil {
+				e.logger.WithError(err).Error("Unable to pack response")
+				return
+			}
+			writeLock.Lock()
+			err = e.writeMsg(conn, payload)
+			writeLock.Unlock()
+			if err != nil {
+				e.logger.WithError(err).Warnf("Unable to write response to %s", conn.RemoteAddr())
+			}
+		}(identity)
+	}
+}
+
+func (e *Endpoint) handleQuery(clientIP net.IP, identity string, query *dns.Msg) *dns.Msg {
+	if len(query.Question) == 0 {
+		return new(dns.Msg).SetRcodeFormatError(query)
+	}
+	ctx := types.NewContext(clientIP, query)
+	ctx.SetClientIdentity(identity)
+	e.handler(ctx)
+	return dnsutil.Reply(ctx)
+}
+
+func (e *Endpoint) readMsg(conn net.Conn) ([]byte, error) {
+	var length [2]byte
+	// Wait for next query no longer than idle timeout
+	conn.SetReadDeadline(deadline(e.opts.IdleTimeout))
+	if _, err := io.ReadFull(conn, length[:1]); err != nil {
+		return nil, err
+	}
+	conn.SetReadDeadline(deadline(e.opts.ReadTimeout))
+	if _, err := io.ReadFull(conn, length[1:]); err != nil {
+		return nil, err
+	}
+	raw := make([]byte, binary.BigEndian.Uint16(length[:]))
+	if _, err := io.ReadFull(conn, raw); err != nil {
+		return nil, err
+	}
+	return raw, nil
+}
+
+func (e *Endpoint) writeMsg(conn net.Conn, payload []byte) error {
+	buf := make([]byte, 2+len(payload))
+	binary.BigEndian.PutUint16(buf, uint16(len(payload)))
+	copy(buf[2:], payload)
+	conn.SetWriteDeadline(deadline(e.opts.ReadTimeout))
+	_, err := conn.Write(buf)
+	return err
+}
+
+func deadline(timeout time.Duration) time.Time {
+	if timeout <= 0 {
+		return time.Time{}
+	}
+	return time.Now().Add(timeout)
+}
+
+func (e *Endpoint) Close() error {
+	e.listenerLock.Lock()
+	defer e.listenerLock.Unlock()
+	close(e.stopCh)
+	if e.listener == nil {
+		return nil
+	}
+	return e.listener.Close()
+}
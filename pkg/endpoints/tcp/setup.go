@@ -0,0 +1,90 @@
+package tcp
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/blho/apexdns/pkg/server"
+	"github.com/blho/apexdns/pkg/types"
+	"github.com/blho/apexdns/pkg/utils/proxyprotocol"
+
+	"github.com/caddyserver/caddy/caddyfile"
+)
+
+const (
+	Name = "tcp"
+)
+
+func init() {
+	server.RegisterEndpoint(types.EndpointInitializer{
+		Name:        Name,
+		Description: "DNS over TCP resolver endpoint",
+		SetupFunc: func(config types.EndpointConfig) (types.Endpoint, error) {
+			return parse(config)
+		},
+	})
+}
+
+func parse(c types.EndpointConfig) (endpoint types.Endpoint, err error) {
+	if !c.Next() {
+		return nil, errors.New("invalid TCP endpoint config")
+	}
+	args := c.RemainingArgs()
+	if len(args) != 1 {
+		return nil, fmt.Errorf("invalid TCP endpoint arguments: %v", args)
+	}
+	opts := NewDefaultOptions()
+	for c.NextBlock() {
+		ok, err := ParseOption(&c.Dispenser, &opts)
+		if err != nil {
+			return nil, err
+		}
+		if !ok {
+			return nil, fmt.Errorf("unknown config in TCP endpoint: %s %v", c.Val(), c.RemainingArgs())
+		}
+	}
+	return New(args[0], opts, c.Handler, c.Logger)
+}
+
+// ParseOption parses the stream option which dispenser currently points to,
+// returns false if it's not a stream option
+func ParseOption(c *caddyfile.Dispenser, opts *Options) (bool, error) {
+	switch c.Val() {
+	case "idle_timeout", "read_timeout":
+		key := c.Val()
+		args := c.RemainingArgs()
+		if len(args) != 1 {
+			return true, fmt.Errorf("invalid %s arguments: %v", key, args)
+		}
+		timeout, err := time.ParseDuration(args[0])
+		if err != nil {
+			return true, err
+		}
+		if key == "idle_timeout" {
+			opts.IdleTimeout = timeout
+		} else {
+			opts.ReadTimeout = timeout
+		}
+	case "max_connections":
+		args := c.RemainingArgs()
+		if len(args) != 1 {
+			return true, fmt.Errorf("invalid max_connections arguments: %v", args)
+		}
+		maxConnections, err := strconv.Atoi(args[0])
+		if err != nil {
+			return true, err
+		}
+		opts.MaxConnections = maxConnections
+	case "proxy_protocol":
+		allowed, err := proxyprotocol.ParseAllowed(c.RemainingArgs())
+		if err != nil {
+			return true, err
+		}
+		opts.ProxyProtocol = append(opts.ProxyProtocol, allowed...)
+	default:
+		return false, nil
+	}
+	return true, nil
+}
@@ -0,0 +1,40 @@
+package tls
+
+import (
+	"crypto/tls"
+
+	"github.com/blho/apexdns/pkg/endpoints/tcp"
+	"github.com/blho/apexdns/pkg/types"
+
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// ALPN of DNS over TLS
+	ALPN = "dot"
+)
+
+// Endpoint serves RFC 7858 DNS over TLS, which is DNS over TCP wrapped in TLS
+type Endpoint struct {
+	*tcp.Endpoint
+	tlsConfig *tls.Config
+}
+
+func New(listenAddress string, tlsConfig *tls.Config, opts tcp.Options, handler types.ContextHandler, logger *logrus.Entry) (*Endpoint, error) {
+	stream, err := tcp.New(listenAddress, opts, handler, logger)
+	if err != nil {
+		return nil, err
+	}
+	return &Endpoint{
+		Endpoint:  stream,
+		tlsConfig: tlsConfig,
+	}, nil
+}
+
+func (e *Endpoint) Run() error {
+	listener, err := e.Listen()
+	if err != nil {
+		return err
+	}
+	return e.Serve(tls.NewListener(listener, e.tlsConfig))
+}
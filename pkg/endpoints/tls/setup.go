@@ -0,0 +1,84 @@
+package tls
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/blho/apexdns/pkg/endpoints/tcp"
+	"github.com/blho/apexdns/pkg/server"
+	"github.com/blho/apexdns/pkg/types"
+	"github.com/blho/apexdns/pkg/utils/tlsutil"
+)
+
+const (
+	Name = "tls"
+)
+
+func init() {
+	server.RegisterEndpoint(types.EndpointInitializer{
+		Name:        Name,
+		Description: "DNS over TLS resolver endpoint",
+		SetupFunc: func(config types.EndpointConfig) (types.Endpoint, error) {
+			return parse(config)
+		},
+	})
+}
+
+func parse(c types.EndpointConfig) (endpoint types.Endpoint, err error) {
+	if !c.Next() {
+		return nil, errors.New("invalid TLS endpoint config")
+	}
+	// args listenAddr certFile keyFile
+	args := c.RemainingArgs()
+	if len(args) != 3 {
+		return nil, fmt.Errorf("invalid TLS endpoint arguments: %v", args)
+	}
+	tlsConfig, err := tlsutil.NewServerConfig(args[1], args[2], ALPN)
+	if err != nil {
+		return nil, err
+	}
+	opts := tcp.NewDefaultOptions()
+	for c.NextBlock() {
+		ok, err := tcp.ParseOption(&c.Dispenser, &opts)
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			continue
+		}
+		switch key := c.Val(); key {
+		case "min_version", "max_version":
+			args := c.RemainingArgs()
+			if len(args) != 1 {
+				return nil, fmt.Errorf("invalid %s arguments: %v", key, args)
+			}
+			version, err := tlsutil.ParseVersion(args[0])
+			if err != nil {
+				return nil, err
+			}
+			if key == "min_version" {
+				tlsConfig.MinVersion = version
+			} else {
+				tlsConfig.MaxVersion = version
+			}
+		case "session_tickets":
+			args := c.RemainingArgs()
+			if len(args) != 1 || (args[0] != "on" && args[0] != "off") {
+				return nil, fmt.Errorf("invalid session_tickets arguments: %v", args)
+			}
+			tlsConfig.SessionTicketsDisabled = args[0] == "off"
+		case "client_ca":
+			// Require client certificate signed by CA
+			args := c.RemainingArgs()
+			if len(args) != 1 {
+				return nil, fmt.Errorf("invalid client_ca arguments: %v", args)
+			}
+			if err := tlsutil.SetClientCA(tlsConfig, args[0], true); err != nil {
+				return nil, err
+			}
+		default:
+			return nil, fmt.Errorf("unknown config in TLS endpoint: %s %v", key, c.RemainingArgs())
+		}
+	}
+	return New(args[0], tlsConfig, opts, c.Handler, c.Logger)
+}
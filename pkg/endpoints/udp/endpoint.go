@@ -0,0 +1,120 @@
+package udp
+
+import (
+	"net"
+	"sync"
+
+	"github.com/blho/apexdns/pkg/types"
+	"github.com/blho/apexdns/pkg/utils/dnsutil"
+	"github.com/blho/apexdns/pkg/utils/netutil"
+	"github.com/blho/apexdns/pkg/utils/proxyprotocol"
+
+	"github.com/miekg/dns"
+	"github.com/sirupsen/logrus"
+)
+
+type Endpoint struct {
+	listenAddress string
+	proxyProtocol []*net.IPNet
+	connLock      sync.Mutex
+	conn          net.PacketConn
+	stopCh        chan struct{}
+	handler       types.ContextHandler
+	logger        *logrus.Entry
+}
+
+// New returns UDP endpoint, PROXY protocol v2 header from balancers in proxyProtocol will be accepted
+func New(listenAddress string, proxyProtocol []*net.IPNet, handler types.ContextHandler, logger *logrus.Entry) (*Endpoint, error) {
+	e := &Endpoint{
+		listenAddress: listenAddress,
+		proxyProtocol: proxyProtocol,
+		stopCh:        make(chan struct{}),
+		handler:       handler,
+		logger:        logger,
+	}
+	return e, nil
+}
+
+func (e *Endpoint) Run() error {
+	conn, err := net.ListenPacket("udp", e.listenAddress)
+	if err != nil {
+		return err
+	}
+	e.connLock.Lock()
+	select {
+	case <-e.stopCh:
+		// Closed before listening
+		e.connLock.Unlock()
+		return conn.Close()
+	default:
+	}
+	e.conn = conn
+	e.connLock.Unlock()
+	e.logger.Infof("Listening on %s", conn.LocalAddr())
+	// Datagram is copied out of the read buffer for its own goroutine, so the buffer is reused
+	buf := make([]byte, dns.MaxMsgSize)
+	for {
+		n, addr, err := conn.ReadFrom(buf)
+		if err != nil {
+			select {
+			case <-e.stopCh:
+				return nil
+			default:
+			}
+			if netErr, ok := err.(net.Error); ok && netErr.Temporary() {
+				continue
+			}
+			return err
+		}
+		go e.serve(conn, append([]byte(nil), buf[:n]...), addr)
+	}
+}
+
+func (e *Endpoint) serve(conn net.PacketConn, raw []byte, addr net.Addr) {
+	clientAddr := addr
+	if len(e.proxyProtocol) > 0 {
+		var err error
+		raw, clientAddr, err = proxyprotocol.ReadPacketHeader(raw, addr, e.proxyProtocol)
+		if err != nil {
+			e.logger.WithError(err).Debugf("Unable to read PROXY protocol header from %s", addr)
+			return
+		}
+	}
+	query := new(dns.Msg)
+	if err := query.Unpack(raw); err != nil {
+		// Not a DNS message, drop it
+		e.logger.WithError(err).Debugf("Unable to unpack query from %s", addr)
+		return
+	}
+	if query.Response {
+		return
+	}
+	var resp *dns.Msg
+	if len(query.Question) == 0 {
+		resp = new(dns.Msg).SetRcodeFormatError(query)
+	} else {
+		ctx := types.NewContext(netutil.IPFromAddr(clientAddr), query)
+		e.handler(ctx)
+		resp = dnsutil.Reply(ctx)
+	}
+	// Respect the client's buffer size, Truncate sets TC bit if answer doesn't fit
+	resp.Truncate(dnsutil.UDPSize(query))
+	payload, err := resp.Pack()
+	if err != nil {
+		e.logger.WithError(err).Error("Unable to pack response")
+		return
+	}
+	if _, err = conn.WriteTo(payload, addr); err != nil {
+		e.logger.WithError(err).Warnf("Unable to write response to %s", addr)
+	}
+}
+
+func (e *Endpoint) Close() error {
+	e.connLock.Lock()
+	defer e.connLock.Unlock()
+	close(e.stopCh)
+	if e.conn == nil {
+		return nil
+	}
+	return e.conn.Close()
+}
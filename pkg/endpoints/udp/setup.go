@@ -0,0 +1,49 @@
+package udp
+
+import (
+	"errors"
+	"fmt"
+	"net"
+
+	"github.com/blho/apexdns/pkg/server"
+	"github.com/blho/apexdns/pkg/types"
+	"github.com/blho/apexdns/pkg/utils/proxyprotocol"
+)
+
+const (
+	Name = "udp"
+)
+
+func init() {
+	server.RegisterEndpoint(types.EndpointInitializer{
+		Name:        Name,
+		Description: "Classic DNS over UDP resolver endpoint",
+		SetupFunc: func(config types.EndpointConfig) (types.Endpoint, error) {
+			return parse(config)
+		},
+	})
+}
+
+func parse(c types.EndpointConfig) (endpoint types.Endpoint, err error) {
+	if !c.Next() {
+		return nil, errors.New("invalid UDP endpoint config")
+	}
+	args := c.RemainingArgs()
+	if len(args) != 1 {
+		return nil, fmt.Errorf("invalid UDP endpoint arguments: %v", args)
+	}
+	var proxyProtocol []*net.IPNet
+	for c.NextBlock() {
+		switch key := c.Val(); key {
+		case "proxy_protocol":
+			allowed, err := proxyprotocol.ParseAllowed(c.RemainingArgs())
+			if err != nil {
+				return nil, err
+			}
+			proxyProtocol = append(proxyProtocol, allowed...)
+		default:
+			return nil, fmt.Errorf("unknown config in UDP endpoint: %s %v", key, c.RemainingArgs())
+		}
+	}
+	return New(args[0], proxyProtocol, c.Handler, c.Logger)
+}
@@ -0,0 +1,239 @@
+package upstream
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+const (
+	defaultBootstrapPort    = "53"
+	defaultBootstrapTimeout = 2 * time.Second
+	// Resolved addresses are kept at least for a while even if TTL is zero
+	bootstrapMinTTL = 5 * time.Second
+)
+
+// bootstrapResolver resolves upstream hostnames through plain DNS servers, results are cached by TTL
+type bootstrapResolver struct {
+	servers []string
+	client  *dns.Client
+	cache   map[string]*bootstrapEntry
+	lock    sync.Mutex
+}
+
+type bootstrapEntry struct {
+	ips      []net.IP
+	expireAt time.Time
+	// preferred is the index of IP tried first, it moves to the next one once the IP fails
+	preferred int
+}
+
+// ordered returns IPs starting from the preferred one
+func (e *bootstrapEntry) ordered() []net.IP {
+	return append(append([]net.IP(nil), e.ips[e.preferred:]...), e.ips[:e.preferred]...)
+}
+
+func newBootstrapResolver(servers []string) (*bootstrapResolver, error) {
+	r := &bootstrapResolver{
+		client: &dns.Client{Net: "udp", Timeout: defaultBootstrapTimeout},
+		cache:  make(map[string]*bootstrapEntry),
+	}
+	for _, server := range servers {
+		if net.ParseIP(server) != nil {
+			server = net.JoinHostPort(server, defaultBootstrapPort)
+		}
+		host, _, err := net.SplitHostPort(server)
+		if err != nil || net.ParseIP(host) == nil {
+			return nil, fmt.Errorf("invalid bootstrap server: %s", server)
+		}
+		r.servers = append(r.servers, server)
+	}
+	return r, nil
+}
+
+// lookup returns IPs of host starting from the preferred one, it's re-resolved once TTL expired.
+// Expired result is still used if bootstrap servers are unavailable.
+func (r *bootstrapResolver) lookup(ctx context.Context, host string) ([]net.IP, error) {
+	r.lock.Lock()
+	entry := r.cache[host]
+	if entry != nil && time.Now().Before(entry.expireAt) {
+		defer r.lock.Unlock()
+		return entry.ordered(), nil
+	}
+	r.lock.Unlock()
+	ips, ttl, err := r.resolve(ctx, host)
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if err != nil {
+		if entry != nil {
+			return entry.ordered(), nil
+		}
+		return nil, err
+	}
+	if ttl < bootstrapMinTTL {
+		ttl = bootstrapMinTTL
+	}
+	r.cache[host] = &bootstrapEntry{ips: ips, expireAt: time.Now().Add(ttl)}
+	return ips, nil
+}
+
+// prefer makes ip of host tried first
+func (r *bootstrapResolver) prefer(host string, ip net.IP) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if entry := r.cache[host]; entry != nil {
+		for i := range entry.ips {
+			if entry.ips[i].Equal(ip) {
+				entry.preferred = i
+				return
+			}
+		}
+	}
+}
+
+// fail moves to the next IP of host if ip is the preferred one
+func (r *bootstrapResolver) fail(host string, ip net.IP) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if entry := r.cache[host]; entry != nil && entry.ips[entry.preferred].Equal(ip) {
+		entry.preferred = (entry.preferred + 1) % len(entry.ips)
+	}
+}
+
+// resolve queries A and AAAA records of host, IPv4 addresses come first
+func (r *bootstrapResolver) resolve(ctx context.Context, host string) ([]net.IP, time.Duration, error) {
+	var (
+		ips    []net.IP
+		minTTL uint32
+		errs   []error
+	)
+	for _, qtype := range []uint16{dns.TypeA, dns.TypeAAAA} {
+		response, err := r.query(ctx, host, qtype)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		for _, rr := range response.Answer {
+			var ip net.IP
+			switch record := rr.(type) {
+			case *dns.A:
+				ip = record.A
+			case *dns.AAAA:
+				ip = record.AAAA
+			default:
+				continue
+			}
+			if len(ips) == 0 || rr.Header().Ttl < minTTL {
+				minTTL = rr.Header().Ttl
+			}
+			ips = append(ips, ip)
+		}
+	}
+	if len(ips) == 0 {
+		if len(errs) > 0 {
+			return nil, 0, fmt.Errorf("unable to bootstrap %s: %w", host, errors.Join(errs...))
+		}
+		return nil, 0, fmt.Errorf("no address of %s found by bootstrap", host)
+	}
+	return ips, time.Duration(minTTL) * time.Second, nil
+}
+
+// query tries bootstrap servers in order
+func (r *bootstrapResolver) query(ctx context.Context, host string, qtype uint16) (*dns.Msg, error) {
+	msg := new(dns.Msg)
+	msg.SetQuestion(dns.Fqdn(host), qtype)
+	var err error
+	for _, server := range r.servers {
+		var response *dns.Msg
+		response, _, err = r.client.ExchangeContext(ctx, msg, server)
+		if err != nil {
+			continue
+		}
+		if response.Rcode != dns.RcodeSuccess {
+			err = fmt.Errorf("bootstrap server %s responded %s", server, dns.RcodeToString[response.Rcode])
+			continue
+		}
+		return response, nil
+	}
+	return nil, err
+}
+
+// resolveAddrs replaces hostname of addr with IPs resolved by bootstrap servers, the preferred one comes first.
+// System resolver is used if there is no bootstrap server.
+func (u *ups) resolveAddrs(ctx context.Context, addr string) ([]string, error) {
+	if u.bootstrap == nil {
+		return []string{addr}, nil
+	}
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	if net.ParseIP(host) != nil {
+		return []string{addr}, nil
+	}
+	ips, err := u.bootstrap.lookup(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+	addrs := make([]string, 0, len(ips))
+	for _, ip := range ips {
+		addrs = append(addrs, net.JoinHostPort(ip.String(), port))
+	}
+	return addrs, nil
+}
+
+// reportAddr tells bootstrap resolver whether the resolved address of upstream hostname works
+func (u *ups) reportAddr(host, addr string, err error) {
+	if u.bootstrap == nil {
+		return
+	}
+	ipStr, _, _ := net.SplitHostPort(addr)
+	ip := net.ParseIP(ipStr)
+	if ip == nil || net.ParseIP(host) != nil {
+		return
+	}
+	if err != nil {
+		u.bootstrap.fail(host, ip)
+	} else {
+		u.bootstrap.prefer(host, ip)
+	}
+}
+
+// dialResolved dials resolved addresses of addr in order until one succeeds, each of them takes a share of
+// the remaining time as net.Dialer does
+func dialResolved[T any](ctx context.Context, u *ups, addr string, dial func(ctx context.Context, addr string) (T, error)) (T, error) {
+	var zero T
+	addrs, err := u.resolveAddrs(ctx, addr)
+	if err != nil {
+		return zero, err
+	}
+	host, _, _ := net.SplitHostPort(addr)
+	var errs []error
+	for i, resolved := range addrs {
+		attemptCtx, cancel := ctx, context.CancelFunc(func() {})
+		if deadline, ok := ctx.Deadline(); ok && i < len(addrs)-1 {
+			attemptCtx, cancel = context.WithTimeout(ctx, time.Until(deadline)/time.Duration(len(addrs)-i))
+		}
+		result, err := dial(attemptCtx, resolved)
+		cancel()
+		if len(addrs) > 1 {
+			u.reportAddr(host, resolved, err)
+		}
+		if err == nil {
+			return result, nil
+		}
+		errs = append(errs, err)
+		if ctx.Err() != nil {
+			break
+		}
+	}
+	if len(errs) == 1 {
+		return zero, errs[0]
+	}
+	return zero, errors.Join(errs...)
+}
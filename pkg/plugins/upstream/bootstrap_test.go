@@ -0,0 +1,84 @@
+package upstream
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// startBootstrapTestServer answers A records of any name with ips
+func startBootstrapTestServer(t *testing.T, ips ...string) string {
+	t.Helper()
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	started := make(chan struct{})
+	server := &dns.Server{
+		PacketConn:        conn,
+		NotifyStartedFunc: func() { close(started) },
+		Handler: dns.HandlerFunc(func(w dns.ResponseWriter, r *dns.Msg) {
+			response := new(dns.Msg)
+			response.SetReply(r)
+			if r.Question[0].Qtype == dns.TypeA {
+				for _, ip := range ips {
+					rr, _ := dns.NewRR(r.Question[0].Name + " 60 IN A " + ip)
+					response.Answer = append(response.Answer, rr)
+				}
+			}
+			w.WriteMsg(response)
+		}),
+	}
+	go server.ActivateAndServe()
+	<-started
+	t.Cleanup(func() {
+		server.Shutdown()
+	})
+	return conn.LocalAddr().String()
+}
+
+func TestBootstrapFallback(t *testing.T) {
+	for _, network := range []string{"tcp", "udp"} {
+		t.Run(network, func(t *testing.T) {
+			var addr string
+			// Upstream listens on 127.0.0.1 only, nothing on 127.0.0.2
+			if network == "tcp" {
+				addr, _ = startPoolTestServer(t, 0)
+			} else {
+				addr = startTestServer(t, testBehavior{}).addr
+			}
+			_, port, _ := net.SplitHostPort(addr)
+			bootstrap, err := newBootstrapResolver([]string{startBootstrapTestServer(t, "127.0.0.2", "127.0.0.1")})
+			if err != nil {
+				t.Fatal(err)
+			}
+			u, err := newUpstream(network, net.JoinHostPort("dns.test", port), upstreamOptions{pool: newDefaultPoolOptions(), weight: 1, udpSize: defaultUDPSize}, time.Second)
+			if err != nil {
+				t.Fatal(err)
+			}
+			u.bootstrap = bootstrap
+
+			// Refused stream connection falls back at once, UDP moves on after the failed exchange
+			response, err := exchangeA(u, "example.com.")
+			if network == "udp" {
+				if err == nil {
+					t.Fatal("expect exchange with unreachable address to fail")
+				}
+				response, err = exchangeA(u, "example.com.")
+			}
+			if err != nil || response == nil {
+				t.Fatalf("exchange failed: %v", err)
+			}
+			addrs, err := u.resolveAddrs(context.Background(), u.addr)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if expect := net.JoinHostPort("127.0.0.1", port); addrs[0] != expect {
+				t.Errorf("expect %s preferred, got %v", expect, addrs)
+			}
+		})
+	}
+}
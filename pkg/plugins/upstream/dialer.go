@@ -0,0 +1,48 @@
+package upstream
+
+import (
+	"context"
+	"net"
+)
+
+// dialOptions of sockets to upstream, e.g. policy routing by source address, interface or fwmark
+type dialOptions struct {
+	// sourceIP is the local address of sockets
+	sourceIP net.IP
+	// iface binds sockets to the interface by SO_BINDTODEVICE
+	iface string
+	// mark sets SO_MARK of sockets
+	mark uint32
+	// tfo enables TCP Fast Open
+	tfo bool
+}
+
+func (o dialOptions) isSet() bool {
+	return o.sourceIP != nil || o.iface != "" || o.mark != 0 || o.tfo
+}
+
+// newDialer returns dialer of network with dial options applied
+func (u *ups) newDialer(network string) *net.Dialer {
+	dialer := &net.Dialer{
+		Timeout: u.timeout,
+		Control: u.dialOpts.control,
+	}
+	if ip := u.dialOpts.sourceIP; ip != nil {
+		if network == "udp" {
+			dialer.LocalAddr = &net.UDPAddr{IP: ip}
+		} else {
+			dialer.LocalAddr = &net.TCPAddr{IP: ip}
+		}
+	}
+	return dialer
+}
+
+// listenPacket returns UDP socket with dial options applied, it's used by QUIC
+func (u *ups) listenPacket(ctx context.Context) (net.PacketConn, error) {
+	listenConfig := &net.ListenConfig{Control: u.dialOpts.control}
+	addr := ":0"
+	if ip := u.dialOpts.sourceIP; ip != nil {
+		addr = net.JoinHostPort(ip.String(), "0")
+	}
+	return listenConfig.ListenPacket(ctx, "udp", addr)
+}
@@ -0,0 +1,36 @@
+package upstream
+
+import (
+	"strings"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+func (o dialOptions) validate() error {
+	return nil
+}
+
+func (o dialOptions) control(network, _ string, c syscall.RawConn) error {
+	var err error
+	controlErr := c.Control(func(fd uintptr) {
+		if o.iface != "" {
+			if err = unix.BindToDevice(int(fd), o.iface); err != nil {
+				return
+			}
+		}
+		if o.mark != 0 {
+			if err = unix.SetsockoptInt(int(fd), unix.SOL_SOCKET, unix.SO_MARK, int(o.mark)); err != nil {
+				return
+			}
+		}
+		if o.tfo && strings.HasPrefix(network, "tcp") {
+			// Data of the first write is sent in SYN, no explicit sendto is required
+			err = unix.SetsockoptInt(int(fd), unix.IPPROTO_TCP, unix.TCP_FASTOPEN_CONNECT, 1)
+		}
+	})
+	if controlErr != nil {
+		return controlErr
+	}
+	return err
+}
@@ -0,0 +1,19 @@
+//go:build !linux
+
+package upstream
+
+import (
+	"errors"
+	"syscall"
+)
+
+func (o dialOptions) validate() error {
+	if o.iface != "" || o.mark != 0 || o.tfo {
+		return errors.New("interface, mark and tfo of upstream are only supported on Linux")
+	}
+	return nil
+}
+
+func (o dialOptions) control(string, string, syscall.RawConn) error {
+	return nil
+}
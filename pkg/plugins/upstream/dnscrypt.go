@@ -0,0 +1,125 @@
+package upstream
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/ameshkov/dnscrypt/v2"
+	"github.com/ameshkov/dnsstamps"
+	"github.com/miekg/dns"
+)
+
+const (
+	// Resolver certificate will be fetched again after this interval even it's not expired
+	dnscryptCertRefreshInterval = time.Hour
+	// Read and write timeout of DNSCrypt client if upstream has none
+	defaultDNSCryptTimeout = 5 * time.Second
+)
+
+type dnscryptResolver struct {
+	stamp     dnsstamps.ServerStamp
+	udpClient *dnscrypt.Client
+	tcpClient *dnscrypt.Client
+	info      *dnscrypt.ResolverInfo
+	refreshAt time.Time
+	lock      sync.Mutex
+}
+
+func (u *ups) setupDNSCrypt() error {
+	stamp, err := dnsstamps.NewServerStampFromString(u.addr)
+	if err != nil {
+		return err
+	}
+	if stamp.Proto != dnsstamps.StampProtoTypeDNSCrypt {
+		return fmt.Errorf("not a DNSCrypt stamp: %s", u.addr)
+	}
+	timeout := u.timeout
+	if timeout <= 0 {
+		timeout = defaultDNSCryptTimeout
+	}
+	u.dnscrypt = &dnscryptResolver{
+		stamp: stamp,
+		udpClient: &dnscrypt.Client{
+			Net:     "udp",
+			Timeout: timeout,
+			UDPSize: dns.MaxMsgSize,
+		},
+		tcpClient: &dnscrypt.Client{
+			Net:     "tcp",
+			Timeout: timeout,
+		},
+	}
+	return nil
+}
+
+// getResolverInfo returns the resolver certificate and shared key, certificate is rotated before it expires
+func (r *dnscryptResolver) getResolverInfo() (*dnscrypt.ResolverInfo, error) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	now := time.Now()
+	if r.info != nil && now.Before(r.refreshAt) {
+		return r.info, nil
+	}
+	info, err := r.udpClient.DialStamp(r.stamp)
+	if err != nil {
+		if r.info != nil && now.Before(certExpiration(r.info.ResolverCert)) {
+			// Keep using current certificate, try again later
+			r.refreshAt = now.Add(time.Minute)
+			return r.info, nil
+		}
+		return nil, fmt.Errorf("unable to fetch DNSCrypt certificate from %s: %w", r.stamp.ServerAddrStr, err)
+	}
+	r.info = info
+	r.refreshAt = now.Add(dnscryptCertRefreshInterval)
+	if expireAt := certExpiration(info.ResolverCert); expireAt.Before(r.refreshAt) {
+		r.refreshAt = expireAt
+	}
+	return info, nil
+}
+
+// refresh makes the certificate to be fetched again on next query, it may be rotated by resolver
+func (r *dnscryptResolver) refresh(info *dnscrypt.ResolverInfo) {
+	r.lock.Lock()
+	if r.info == info {
+		r.refreshAt = time.Now()
+	}
+	r.lock.Unlock()
+}
+
+func certExpiration(cert *dnscrypt.Cert) time.Time {
+	return time.Unix(int64(cert.NotAfter), 0)
+}
+
+// exchangeViaDNSCrypt sends encrypted query over UDP, and retries over TCP if the response is truncated
+func (u *ups) exchangeViaDNSCrypt(ctx context.Context, msg *dns.Msg) (*dns.Msg, time.Duration, error) {
+	info, err := u.dnscrypt.getResolverInfo()
+	if err != nil {
+		return nil, 0, err
+	}
+	startAt := time.Now()
+	response, err := u.exchangeDNSCryptConn(ctx, u.dnscrypt.udpClient, msg, info)
+	if err == nil && response.Truncated {
+		response, err = u.exchangeDNSCryptConn(ctx, u.dnscrypt.tcpClient, msg, info)
+	}
+	if err != nil && ctx.Err() == nil {
+		u.dnscrypt.refresh(info)
+	}
+	return response, time.Since(startAt), err
+}
+
+func (u *ups) exchangeDNSCryptConn(ctx context.Context, client *dnscrypt.Client, msg *dns.Msg,
+	info *dnscrypt.ResolverInfo) (*dns.Msg, error) {
+	conn, err := u.newDialer(client.Net).DialContext(ctx, client.Net, info.ServerAddress)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	// Interrupt blocking read and write if exchange is cancelled
+	stop := context.AfterFunc(ctx, func() {
+		conn.SetDeadline(time.Now())
+	})
+	defer stop()
+	return client.ExchangeConn(conn, msg, info)
+}
@@ -0,0 +1,230 @@
+package upstream
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"fmt"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/ameshkov/dnscrypt/v2"
+	"github.com/miekg/dns"
+)
+
+// dnscryptTestServer is an in-process DNSCrypt resolver on loopback
+type dnscryptTestServer struct {
+	server  *dnscrypt.Server
+	udpConn *net.UDPConn
+	tcpLn   net.Listener
+	stamp   string
+	cert    *dnscrypt.Cert
+	// queries received over UDP and TCP
+	udpQueries atomic.Int32
+	tcpQueries atomic.Int32
+}
+
+// startDNSCryptTestServer listens on addr with a new resolver certificate signed by providerKey
+func startDNSCryptTestServer(t *testing.T, providerKey ed25519.PrivateKey, addr string, ttl time.Duration) *dnscryptTestServer {
+	t.Helper()
+	rc, err := dnscrypt.GenerateResolverConfig("2.dnscrypt-cert.apexdns.test", providerKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rc.CertificateTTL = ttl
+	cert, err := rc.CreateCert()
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &dnscryptTestServer{cert: cert}
+	udpAddr, err := net.ResolveUDPAddr("udp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.udpConn, err = net.ListenUDP("udp", udpAddr); err != nil {
+		t.Fatal(err)
+	}
+	if s.tcpLn, err = net.Listen("tcp", s.udpConn.LocalAddr().String()); err != nil {
+		t.Fatal(err)
+	}
+	stamp, err := rc.CreateStamp(s.udpConn.LocalAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.stamp = stamp.String()
+	s.server = &dnscrypt.Server{
+		ProviderName: rc.ProviderName,
+		ResolverCert: cert,
+		Handler:      s,
+	}
+	go s.server.ServeUDP(s.udpConn)
+	go s.server.ServeTCP(s.tcpLn)
+	return s
+}
+
+func (s *dnscryptTestServer) addr() string {
+	return s.udpConn.LocalAddr().String()
+}
+
+func (s *dnscryptTestServer) close() {
+	s.server.Shutdown(context.Background())
+	s.udpConn.Close()
+	s.tcpLn.Close()
+}
+
+// ServeDNS answers A record, or 40 TXT records for names starting with "big"
+func (s *dnscryptTestServer) ServeDNS(rw dnscrypt.ResponseWriter, r *dns.Msg) error {
+	if rw.RemoteAddr().Network() == "udp" {
+		s.udpQueries.Add(1)
+	} else {
+		s.tcpQueries.Add(1)
+	}
+	response := new(dns.Msg)
+	response.SetReply(r)
+	name := r.Question[0].Name
+	if dns.SplitDomainName(name)[0] == "big" {
+		for i := 0; i < 40; i++ {
+			rr, _ := dns.NewRR(fmt.Sprintf("%s 60 IN TXT \"record %d of a response too big for UDP\"", name, i))
+			response.Answer = append(response.Answer, rr)
+		}
+	} else {
+		rr, _ := dns.NewRR(name + " 60 IN A 10.0.0.1")
+		response.Answer = append(response.Answer, rr)
+	}
+	return rw.WriteMsg(response)
+}
+
+func newDNSCryptTestUpstream(t *testing.T, stamp string) *ups {
+	t.Helper()
+	u, err := newUpstream("dnscrypt", stamp, upstreamOptions{pool: newDefaultPoolOptions(), weight: 1}, 500*time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return u
+}
+
+func newProviderKey(t *testing.T) ed25519.PrivateKey {
+	t.Helper()
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key
+}
+
+func exchangeA(u *ups, name string) (*dns.Msg, error) {
+	msg := new(dns.Msg)
+	msg.SetQuestion(name, dns.TypeA)
+	response, _, err := u.Exchange(context.Background(), msg)
+	return response, err
+}
+
+func TestDNSCryptCertificateFetch(t *testing.T) {
+	server := startDNSCryptTestServer(t, newProviderKey(t), "127.0.0.1:0", 30*time.Minute)
+	defer server.close()
+	u := newDNSCryptTestUpstream(t, server.stamp)
+
+	response, err := exchangeA(u, "example.com.")
+	if err != nil {
+		t.Fatalf("exchange failed: %v", err)
+	}
+	if len(response.Answer) != 1 {
+		t.Fatalf("expect 1 answer, got %d", len(response.Answer))
+	}
+	info := u.dnscrypt.info
+	if info == nil || info.ResolverCert.Serial != server.cert.Serial {
+		t.Fatal("resolver certificate is not fetched")
+	}
+	// Certificate expires before the regular refresh interval
+	if expireAt := certExpiration(server.cert); !u.dnscrypt.refreshAt.Equal(expireAt) {
+		t.Errorf("expect refresh at %s, got %s", expireAt, u.dnscrypt.refreshAt)
+	}
+
+	// Certificate is cached
+	if _, err = exchangeA(u, "example.org."); err != nil {
+		t.Fatalf("exchange failed: %v", err)
+	}
+	if u.dnscrypt.info != info {
+		t.Error("certificate is fetched again before refresh")
+	}
+}
+
+func TestDNSCryptCertificateRotation(t *testing.T) {
+	providerKey := newProviderKey(t)
+	server := startDNSCryptTestServer(t, providerKey, "127.0.0.1:0", 0)
+	u := newDNSCryptTestUpstream(t, server.stamp)
+	if _, err := exchangeA(u, "example.com."); err != nil {
+		t.Fatalf("exchange failed: %v", err)
+	}
+	previous := u.dnscrypt.info
+
+	// Resolver rotates its short-term key at the same address
+	addr := server.addr()
+	server.close()
+	server = startDNSCryptTestServer(t, providerKey, addr, 0)
+	defer server.close()
+
+	// Query encrypted by the old key is dropped, the failure makes the certificate to be fetched again
+	if _, err := exchangeA(u, "example.com."); err == nil {
+		t.Fatal("expect exchange with rotated certificate to fail")
+	}
+	response, err := exchangeA(u, "example.com.")
+	if err != nil {
+		t.Fatalf("exchange after rotation failed: %v", err)
+	}
+	if len(response.Answer) != 1 {
+		t.Fatalf("expect 1 answer, got %d", len(response.Answer))
+	}
+	if u.dnscrypt.info == previous {
+		t.Error("certificate is not rotated")
+	}
+}
+
+func TestDNSCryptTruncatedFallback(t *testing.T) {
+	server := startDNSCryptTestServer(t, newProviderKey(t), "127.0.0.1:0", 0)
+	defer server.close()
+	u := newDNSCryptTestUpstream(t, server.stamp)
+
+	msg := new(dns.Msg)
+	msg.SetQuestion("big.example.com.", dns.TypeTXT)
+	response, _, err := u.Exchange(context.Background(), msg)
+	if err != nil {
+		t.Fatalf("exchange failed: %v", err)
+	}
+	if response.Truncated || len(response.Answer) != 40 {
+		t.Fatalf("expect 40 answers not truncated, got %d truncated %v", len(response.Answer), response.Truncated)
+	}
+	if udp, tcp := server.udpQueries.Load(), server.tcpQueries.Load(); udp != 1 || tcp != 1 {
+		t.Errorf("expect 1 UDP and 1 TCP query, got %d and %d", udp, tcp)
+	}
+}
+
+func TestDNSCryptCancel(t *testing.T) {
+	server := startDNSCryptTestServer(t, newProviderKey(t), "127.0.0.1:0", 0)
+	defer server.close()
+	u := newDNSCryptTestUpstream(t, server.stamp)
+	if _, err := exchangeA(u, "example.com."); err != nil {
+		t.Fatalf("exchange failed: %v", err)
+	}
+	// Resolver doesn't respond any more, cancelled exchange returns before timeout
+	addr := server.addr()
+	server.close()
+	silent, err := net.ListenPacket("udp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer silent.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	msg := new(dns.Msg)
+	msg.SetQuestion("example.com.", dns.TypeA)
+	startAt := time.Now()
+	if _, _, err = u.Exchange(ctx, msg); err != context.DeadlineExceeded {
+		t.Fatalf("expect %v, got %v", context.DeadlineExceeded, err)
+	}
+	if elapsed := time.Since(startAt); elapsed > 400*time.Millisecond {
+		t.Errorf("exchange is not interrupted by context, took %s", elapsed)
+	}
+}
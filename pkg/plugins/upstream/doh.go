@@ -0,0 +1,219 @@
+package upstream
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/blho/apexdns/pkg/constant"
+
+	"github.com/miekg/dns"
+)
+
+const (
+	dohMaxIdleConns    = 16
+	dohIdleConnTimeout = 90 * time.Second
+	// Wire format is probed again after falling back to JSON API for a while
+	dohWireFormatRetryInterval = 10 * time.Minute
+)
+
+// dohOptions of DNS over HTTPS upstream
+type dohOptions struct {
+	// useGET sends query by GET instead of POST
+	useGET bool
+	// jsonFallback falls back to Google JSON API if wire format is unsupported by upstream
+	jsonFallback bool
+}
+
+// errWireFormatUnsupported indicates upstream doesn't serve RFC 8484 wire format
+var errWireFormatUnsupported = errors.New("DoH wire format unsupported by upstream")
+
+func (u *ups) setupHTTPClient() error {
+	dialContext := u.newDialer("tcp").DialContext
+	if u.socks5DialFunc != nil {
+		dialContext = u.socks5DialFunc.DialContext
+	}
+	u.httpClient = &http.Client{
+		Timeout: u.timeout,
+		Transport: &http.Transport{
+			DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+				return dialResolved(ctx, u, addr, func(ctx context.Context, addr string) (net.Conn, error) {
+					return dialContext(ctx, network, addr)
+				})
+			},
+			TLSClientConfig:     u.tlsConfig,
+			ForceAttemptHTTP2:   true,
+			MaxIdleConns:        dohMaxIdleConns,
+			MaxIdleConnsPerHost: dohMaxIdleConns,
+			IdleConnTimeout:     dohIdleConnTimeout,
+		},
+	}
+	return nil
+}
+
+func (u *ups) exchangeViaHTTPS(ctx context.Context, msg *dns.Msg) (*dns.Msg, time.Duration, error) {
+	startAt := time.Now()
+	if u.doh.jsonFallback && startAt.UnixNano() < u.wireFormatRetryAt.Load() {
+		response, err := u.exchangeJSON(ctx, msg)
+		return response, time.Since(startAt), err
+	}
+	response, err := u.exchangeWireFormat(ctx, msg)
+	if err == errWireFormatUnsupported && u.doh.jsonFallback {
+		// Remember it for a while, upstream may support wire format later
+		u.wireFormatRetryAt.Store(time.Now().Add(dohWireFormatRetryInterval).UnixNano())
+		response, err = u.exchangeJSON(ctx, msg)
+	}
+	return response, time.Since(startAt), err
+}
+
+// exchangeWireFormat exchanges by RFC 8484
+func (u *ups) exchangeWireFormat(ctx context.Context, msg *dns.Msg) (*dns.Msg, error) {
+	// ID should be zero for HTTP cache friendliness
+	query := msg.Copy()
+	query.Id = 0
+	raw, err := query.Pack()
+	if err != nil {
+		return nil, err
+	}
+	var req *http.Request
+	if u.doh.useGET {
+		req, err = http.NewRequestWithContext(ctx, http.MethodGet,
+			u.addr+querySeparator(u.addr)+"dns="+base64.RawURLEncoding.EncodeToString(raw), nil)
+	} else {
+		req, err = http.NewRequestWithContext(ctx, http.MethodPost, u.addr, bytes.NewReader(raw))
+		if req != nil {
+			req.Header.Set("Content-Type", constant.ContentTypeApplicationDNSMessage)
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", constant.ContentTypeApplicationDNSMessage)
+	resp, err := u.httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusUnsupportedMediaType, http.StatusNotAcceptable:
+		return nil, errWireFormatUnsupported
+	default:
+		return nil, fmt.Errorf("unexpected DoH status: %s", resp.Status)
+	}
+	if contentType := strings.SplitN(resp.Header.Get("Content-Type"), ";", 2)[0]; contentType != constant.ContentTypeApplicationDNSMessage {
+		return nil, errWireFormatUnsupported
+	}
+	body, err := ioutil.ReadAll(io.LimitReader(resp.Body, dns.MaxMsgSize))
+	if err != nil {
+		return nil, err
+	}
+	response := new(dns.Msg)
+	if err = response.Unpack(body); err != nil {
+		return nil, err
+	}
+	response.Id = msg.Id
+	return response, nil
+}
+
+// jsonResponse is the response of Google JSON API
+type jsonResponse struct {
+	Status     int      `json:"Status"`
+	TC         bool     `json:"TC"`
+	RD         bool     `json:"RD"`
+	RA         bool     `json:"RA"`
+	AD         bool     `json:"AD"`
+	CD         bool     `json:"CD"`
+	Answer     []jsonRR `json:"Answer"`
+	Authority  []jsonRR `json:"Authority"`
+	Additional []jsonRR `json:"Additional"`
+}
+
+type jsonRR struct {
+	Name string `json:"name"`
+	Type uint16 `json:"type"`
+	TTL  uint32 `json:"TTL"`
+	Data string `json:"data"`
+}
+
+// exchangeJSON exchanges by Google JSON API
+func (u *ups) exchangeJSON(ctx context.Context, msg *dns.Msg) (*dns.Msg, error) {
+	if len(msg.Question) == 0 {
+		return nil, errors.New("no question in query message")
+	}
+	question := msg.Question[0]
+	params := url.Values{}
+	params.Set("name", question.Name)
+	params.Set("type", strconv.Itoa(int(question.Qtype)))
+	params.Set("cd", strconv.FormatBool(msg.CheckingDisabled))
+	if opt := msg.IsEdns0(); opt != nil {
+		params.Set("do", strconv.FormatBool(opt.Do()))
+		for _, o := range opt.Option {
+			if subnet, ok := o.(*dns.EDNS0_SUBNET); ok {
+				params.Set("edns_client_subnet", fmt.Sprintf("%s/%d", subnet.Address, subnet.SourceNetmask))
+			}
+		}
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.addr+querySeparator(u.addr)+params.Encode(), nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", constant.ContentTypeApplicationDNSJSON)
+	resp, err := u.httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected DoH JSON status: %s", resp.Status)
+	}
+	var payload jsonResponse
+	if err = json.NewDecoder(io.LimitReader(resp.Body, dns.MaxMsgSize)).Decode(&payload); err != nil {
+		return nil, err
+	}
+	response := new(dns.Msg)
+	response.SetReply(msg)
+	response.Rcode = payload.Status
+	response.Truncated = payload.TC
+	response.RecursionDesired = payload.RD
+	response.RecursionAvailable = payload.RA
+	response.AuthenticatedData = payload.AD
+	response.CheckingDisabled = payload.CD
+	for _, section := range []struct {
+		rrs    []jsonRR
+		target *[]dns.RR
+	}{
+		{payload.Answer, &response.Answer},
+		{payload.Authority, &response.Ns},
+		{payload.Additional, &response.Extra},
+	} {
+		for _, rr := range section.rrs {
+			parsed, err := dns.NewRR(fmt.Sprintf("%s %d IN %s %s", dns.Fqdn(rr.Name), rr.TTL, dns.Type(rr.Type), rr.Data))
+			if err != nil {
+				return nil, fmt.Errorf("invalid RR in DoH JSON response: %s", err)
+			}
+			if parsed != nil {
+				*section.target = append(*section.target, parsed)
+			}
+		}
+	}
+	return response, nil
+}
+
+func querySeparator(rawURL string) string {
+	if strings.Contains(rawURL, "?") {
+		return "&"
+	}
+	return "?"
+}
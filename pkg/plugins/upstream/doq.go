@@ -0,0 +1,172 @@
+package upstream
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"io"
+	"net"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/quic-go/quic-go"
+)
+
+const (
+	// ALPN of DNS over QUIC
+	doqALPN        = "doq"
+	doqIdleTimeout = 30 * time.Second
+	// DOQ_REQUEST_CANCELLED error code
+	doqRequestCancelled = 0x3
+)
+
+func (u *ups) setupQUICConfig() {
+	// QUIC requires TLS 1.3
+	u.tlsConfig.MinVersion = tls.VersionTLS13
+	u.tlsConfig.NextProtos = []string{doqALPN}
+	u.quicConfig = &quic.Config{
+		MaxIdleTimeout: doqIdleTimeout,
+		// Peer may drop an idle connection silently, keep it alive until our own idle timer fires
+		KeepAlivePeriod: doqIdleTimeout / 2,
+	}
+}
+
+func (u *ups) exchangeContext(parent context.Context) (context.Context, context.CancelFunc) {
+	if u.timeout > 0 {
+		return context.WithTimeout(parent, u.timeout)
+	}
+	return context.WithCancel(parent)
+}
+
+// dialQUIC establishes QUIC connection to the resolved address
+func (u *ups) dialQUIC(ctx context.Context, addr string) (*quic.Conn, error) {
+	udpAddr, err := net.ResolveUDPAddr("udp", addr)
+	if err != nil {
+		return nil, err
+	}
+	packetConn, err := u.listenPacket(ctx)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := quic.Dial(ctx, packetConn, udpAddr, u.tlsConfig, u.quicConfig)
+	if err != nil {
+		packetConn.Close()
+		return nil, err
+	}
+	// Socket is not owned by QUIC connection
+	context.AfterFunc(conn.Context(), func() {
+		packetConn.Close()
+	})
+	return conn, nil
+}
+
+// getQUICConn returns the alive connection, a new one will be dialed if it was closed(e.g. idle timeout)
+func (u *ups) getQUICConn(parent context.Context) (*quic.Conn, error) {
+	u.quicLock.Lock()
+	defer u.quicLock.Unlock()
+	if u.quicConn != nil {
+		select {
+		case <-u.quicConn.Context().Done():
+			u.quicConn = nil
+		default:
+			u.quicIdleTimer.Reset(doqIdleTimeout)
+			return u.quicConn, nil
+		}
+	}
+	ctx, cancel := u.exchangeContext(parent)
+	defer cancel()
+	conn, err := dialResolved(ctx, u, u.addr, u.dialQUIC)
+	if err != nil {
+		return nil, err
+	}
+	u.quicConn = conn
+	// Close the connection if no query within idle timeout
+	u.quicIdleTimer = time.AfterFunc(doqIdleTimeout, func() {
+		u.resetQUICConn(conn)
+	})
+	return conn, nil
+}
+
+func (u *ups) resetQUICConn(conn *quic.Conn) {
+	u.quicLock.Lock()
+	if u.quicConn == conn {
+		u.quicConn = nil
+		u.quicIdleTimer.Stop()
+	}
+	u.quicLock.Unlock()
+	conn.CloseWithError(0, "")
+}
+
+// exchangeViaQUIC sends query in a new stream of the shared connection as RFC 9250 described
+func (u *ups) exchangeViaQUIC(parent context.Context, msg *dns.Msg) (*dns.Msg, time.Duration, error) {
+	conn, err := u.getQUICConn(parent)
+	if err != nil {
+		return nil, 0, err
+	}
+	ctx, cancel := u.exchangeContext(parent)
+	defer cancel()
+	startAt := time.Now()
+	response, err := u.exchangeWithQUICConn(ctx, conn, msg)
+	if err != nil && conn.Context().Err() != nil && ctx.Err() == nil {
+		// Connection was closed by peer, try again with a new one
+		u.resetQUICConn(conn)
+		if conn, err = u.getQUICConn(ctx); err != nil {
+			return nil, time.Since(startAt), err
+		}
+		startAt = time.Now()
+		response, err = u.exchangeWithQUICConn(ctx, conn, msg)
+	}
+	return response, time.Since(startAt), err
+}
+
+func (u *ups) exchangeWithQUICConn(ctx context.Context, conn *quic.Conn, msg *dns.Msg) (*dns.Msg, error) {
+	stream, err := conn.OpenStreamSync(ctx)
+	if err != nil {
+		return nil, err
+	}
+	// Reset the stream if exchange is cancelled
+	stop := context.AfterFunc(ctx, func() {
+		stream.CancelWrite(doqRequestCancelled)
+		stream.CancelRead(doqRequestCancelled)
+	})
+	defer stop()
+	return u.exchangeWithStream(stream, msg)
+}
+
+func (u *ups) exchangeWithStream(stream *quic.Stream, msg *dns.Msg) (*dns.Msg, error) {
+	if u.timeout > 0 {
+		stream.SetDeadline(time.Now().Add(u.timeout))
+	}
+	// Message ID must be zero in DoQ
+	query := msg.Copy()
+	query.Id = 0
+	raw, err := query.Pack()
+	if err != nil {
+		stream.CancelWrite(0)
+		return nil, err
+	}
+	buf := make([]byte, 2+len(raw))
+	binary.BigEndian.PutUint16(buf, uint16(len(raw)))
+	copy(buf[2:], raw)
+	if _, err = stream.Write(buf); err != nil {
+		return nil, err
+	}
+	// Indicates the end of query
+	if err = stream.Close(); err != nil {
+		return nil, err
+	}
+	var length [2]byte
+	if _, err = io.ReadFull(stream, length[:]); err != nil {
+		return nil, err
+	}
+	payload := make([]byte, binary.BigEndian.Uint16(length[:]))
+	if _, err = io.ReadFull(stream, payload); err != nil {
+		return nil, err
+	}
+	response := new(dns.Msg)
+	if err = response.Unpack(payload); err != nil {
+		return nil, err
+	}
+	response.Id = msg.Id
+	return response, nil
+}
@@ -0,0 +1,106 @@
+package upstream
+
+import (
+	"context"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+const (
+	// Hedging delay if there is no RTT sample of upstream yet
+	defaultHedgeDelay = 100 * time.Millisecond
+	defaultHedgeMax   = 2
+)
+
+// exchangeResult is the outcome of an exchange with upstream
+type exchangeResult struct {
+	upstream *ups
+	response *dns.Msg
+	rtt      time.Duration
+	err      error
+}
+
+// hedgeOptions enables hedged exchange, next upstream is queried if the last one doesn't answer in time
+type hedgeOptions struct {
+	// percentile of RTT of the last queried upstream to wait
+	percentile float64
+	// max upstreams queried for a query
+	max int
+}
+
+func (h *hedgeOptions) delay(u *ups) time.Duration {
+	if delay, ok := u.stats.getPercentile(h.percentile); ok {
+		return delay
+	}
+	return defaultHedgeDelay
+}
+
+// exchange sends query to the first `parallel` upstreams at once, and the following ones by hedging if enabled.
+// The first response not failed wins and other exchanges are cancelled. It returns the number of upstreams queried.
+func (p *Plugin) exchange(parent context.Context, upstreams []*ups, msg *dns.Msg) (exchangeResult, int) {
+	ctx, cancel := context.WithCancel(parent)
+	// Cancel losers
+	defer cancel()
+
+	limit := p.parallel
+	if p.hedge != nil && p.hedge.max > limit {
+		limit = p.hedge.max
+	}
+	if limit > len(upstreams) {
+		limit = len(upstreams)
+	}
+	results := make(chan exchangeResult, limit)
+	var (
+		launched   int
+		hedgeCh    <-chan time.Time
+		hedgeTimer *time.Timer
+	)
+	launch := func() {
+		u := upstreams[launched]
+		launched++
+		go func() {
+			response, rtt, err := u.Exchange(ctx, msg)
+			results <- exchangeResult{upstream: u, response: response, rtt: rtt, err: err}
+		}()
+		hedgeCh = nil
+		if p.hedge != nil && launched < limit {
+			if hedgeTimer != nil {
+				hedgeTimer.Stop()
+			}
+			hedgeTimer = time.NewTimer(p.hedge.delay(u))
+			hedgeCh = hedgeTimer.C
+		}
+	}
+	defer func() {
+		if hedgeTimer != nil {
+			hedgeTimer.Stop()
+		}
+	}()
+	for launched < p.parallel && launched < limit {
+		launch()
+	}
+
+	var last exchangeResult
+	for pending := launched; pending > 0; {
+		select {
+		case r := <-results:
+			pending--
+			if !p.retryOn.failed(r) {
+				return r, launched
+			}
+			if last.response == nil || r.response != nil {
+				last = r
+			}
+			if pending == 0 && hedgeCh != nil {
+				// No need to wait for hedging delay
+				launch()
+				pending++
+			}
+		case <-hedgeCh:
+			launch()
+			pending++
+		}
+	}
+	return last, launched
+}
@@ -0,0 +1,248 @@
+package upstream
+
+import (
+	"context"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// testBehavior describes how a test server answers
+type testBehavior struct {
+	delay time.Duration
+	rcode int
+	// empty answers without records
+	empty bool
+	// drop never answers
+	drop bool
+	// closed has no server listening, exchange fails with network error
+	closed bool
+}
+
+// testServer is a local DNS server over UDP which records when queries arrive
+type testServer struct {
+	server   *dns.Server
+	addr     string
+	behavior testBehavior
+	lock     sync.Mutex
+	queries  []time.Time
+}
+
+func startTestServer(t *testing.T, behavior testBehavior) *testServer {
+	t.Helper()
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &testServer{addr: conn.LocalAddr().String(), behavior: behavior}
+	if behavior.closed {
+		conn.Close()
+		return s
+	}
+	started := make(chan struct{})
+	s.server = &dns.Server{
+		PacketConn:        conn,
+		Handler:           s,
+		NotifyStartedFunc: func() { close(started) },
+	}
+	go s.server.ActivateAndServe()
+	<-started
+	t.Cleanup(func() {
+		s.server.Shutdown()
+	})
+	return s
+}
+
+func (s *testServer) ServeDNS(w dns.ResponseWriter, r *dns.Msg) {
+	s.lock.Lock()
+	s.queries = append(s.queries, time.Now())
+	s.lock.Unlock()
+	if s.behavior.drop {
+		return
+	}
+	time.Sleep(s.behavior.delay)
+	response := new(dns.Msg)
+	response.SetRcode(r, s.behavior.rcode)
+	if s.behavior.rcode == dns.RcodeSuccess && !s.behavior.empty {
+		rr, _ := dns.NewRR(r.Question[0].Name + " 60 IN A 10.0.0.1")
+		response.Answer = append(response.Answer, rr)
+	}
+	w.WriteMsg(response)
+}
+
+func (s *testServer) getQueries() []time.Time {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return append([]time.Time(nil), s.queries...)
+}
+
+// startTestUpstreams starts a server for each behavior and returns UDP upstreams of them in the same order
+func startTestUpstreams(t *testing.T, behaviors []testBehavior, timeout time.Duration) ([]*testServer, []*ups) {
+	t.Helper()
+	var (
+		servers   []*testServer
+		upstreams []*ups
+	)
+	for _, behavior := range behaviors {
+		server := startTestServer(t, behavior)
+		opts := upstreamOptions{pool: newDefaultPoolOptions(), weight: 1, udpSize: defaultUDPSize}
+		u, err := newUpstream("udp", server.addr, opts, timeout)
+		if err != nil {
+			t.Fatal(err)
+		}
+		servers = append(servers, server)
+		upstreams = append(upstreams, u)
+	}
+	return servers, upstreams
+}
+
+func newTestQuery() *dns.Msg {
+	msg := new(dns.Msg)
+	msg.SetQuestion("example.com.", dns.TypeA)
+	return msg
+}
+
+func TestExchange(t *testing.T) {
+	for _, c := range []struct {
+		name      string
+		parallel  int
+		hedge     *hedgeOptions
+		behaviors []testBehavior
+		// RTT samples of the first upstream
+		samples []time.Duration
+		// winner is the index of upstream answered, -1 if all failed
+		winner   int
+		launched int
+		// hedgeAfter is the range of time the second upstream is queried after the first one,
+		// it's measured by server so the lower bound is a bit earlier than the delay
+		hedgeAfter [2]time.Duration
+		// cancelled upstreams are interrupted once the winner answers
+		cancelled []int
+	}{
+		{
+			name:      "parallel first response wins",
+			parallel:  2,
+			behaviors: []testBehavior{{delay: 300 * time.Millisecond}, {}},
+			winner:    1,
+			launched:  2,
+			cancelled: []int{0},
+		},
+		{
+			name:      "parallel all failed",
+			parallel:  2,
+			behaviors: []testBehavior{{rcode: dns.RcodeServerFailure}, {rcode: dns.RcodeRefused}},
+			winner:    -1,
+			launched:  2,
+		},
+		{
+			name:       "hedge after default delay without samples",
+			parallel:   1,
+			hedge:      &hedgeOptions{percentile: 90, max: 2},
+			behaviors:  []testBehavior{{drop: true}, {}},
+			winner:     1,
+			launched:   2,
+			hedgeAfter: [2]time.Duration{90 * time.Millisecond, 250 * time.Millisecond},
+			cancelled:  []int{0},
+		},
+		{
+			name:       "hedge after percentile of RTT",
+			parallel:   1,
+			hedge:      &hedgeOptions{percentile: 90, max: 2},
+			behaviors:  []testBehavior{{drop: true}, {}},
+			samples:    []time.Duration{10 * time.Millisecond, 20 * time.Millisecond, 300 * time.Millisecond},
+			winner:     1,
+			launched:   2,
+			hedgeAfter: [2]time.Duration{290 * time.Millisecond, 600 * time.Millisecond},
+			cancelled:  []int{0},
+		},
+		{
+			name:      "hedge not needed if first answers in time",
+			parallel:  1,
+			hedge:     &hedgeOptions{percentile: 90, max: 2},
+			behaviors: []testBehavior{{}, {}},
+			samples:   []time.Duration{time.Second},
+			winner:    0,
+			launched:  1,
+		},
+		{
+			name:       "hedge at once if nothing is pending",
+			parallel:   1,
+			hedge:      &hedgeOptions{percentile: 90, max: 2},
+			behaviors:  []testBehavior{{rcode: dns.RcodeServerFailure}, {}},
+			samples:    []time.Duration{time.Second},
+			winner:     1,
+			launched:   2,
+			hedgeAfter: [2]time.Duration{0, 500 * time.Millisecond},
+		},
+		{
+			name:      "hedge limited by max",
+			parallel:  1,
+			hedge:     &hedgeOptions{percentile: 90, max: 2},
+			behaviors: []testBehavior{{rcode: dns.RcodeServerFailure}, {rcode: dns.RcodeServerFailure}, {}},
+			winner:    -1,
+			launched:  2,
+		},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			servers, upstreams := startTestUpstreams(t, c.behaviors, 2*time.Second)
+			for _, sample := range c.samples {
+				upstreams[0].stats.record(sample, nil)
+			}
+			p := New()
+			p.parallel = c.parallel
+			p.hedge = c.hedge
+
+			result, launched := p.exchange(context.Background(), upstreams, newTestQuery())
+			if launched != c.launched {
+				t.Errorf("expect %d upstreams launched, got %d", c.launched, launched)
+			}
+			if c.winner >= 0 {
+				if result.err != nil || result.response == nil || result.response.Rcode != dns.RcodeSuccess {
+					t.Fatalf("expect success, got response %v error %v", result.response, result.err)
+				}
+				if result.upstream != upstreams[c.winner] {
+					t.Errorf("expect upstream %d to win, got %s", c.winner, result.upstream.addr)
+				}
+			} else if !p.retryOn.failed(result) {
+				t.Errorf("expect failed result, got response %v error %v", result.response, result.err)
+			}
+
+			if c.hedgeAfter[1] > 0 {
+				first, second := servers[0].getQueries(), servers[1].getQueries()
+				if len(first) != 1 || len(second) != 1 {
+					t.Fatalf("expect 1 query of each upstream, got %d and %d", len(first), len(second))
+				}
+				if after := second[0].Sub(first[0]); after < c.hedgeAfter[0] || after >= c.hedgeAfter[1] {
+					t.Errorf("expect hedging in [%s, %s), got %s", c.hedgeAfter[0], c.hedgeAfter[1], after)
+				}
+			}
+			for i, server := range servers[launched:] {
+				if queries := server.getQueries(); len(queries) != 0 {
+					t.Errorf("upstream %d is not launched but queried", launched+i)
+				}
+			}
+
+			for _, i := range c.cancelled {
+				s := &upstreams[i].stats
+				// Losers are cancelled in background
+				for deadline := time.Now().Add(time.Second); s.getInflight() != 0 && time.Now().Before(deadline); {
+					time.Sleep(5 * time.Millisecond)
+				}
+				if inflight := s.getInflight(); inflight != 0 {
+					t.Fatalf("upstream %d is not cancelled, %d in flight", i, inflight)
+				}
+				s.lock.RLock()
+				sampleCount, errorRate, srtt := s.sampleCount, s.errorRate, s.srtt
+				s.lock.RUnlock()
+				// Cancelled exchange counts as a slow one rather than a failure
+				if sampleCount != len(c.samples) || errorRate != 0 || srtt == 0 {
+					t.Errorf("expect upstream %d recorded as cancelled, got %d samples, error rate %f, srtt %f",
+						i, sampleCount, errorRate, srtt)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,119 @@
+package upstream
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	defaultHealthCheckName       = "."
+	defaultHealthCheckFailures   = 3
+	defaultHealthCheckRecoveries = 2
+)
+
+var defaultHealthCheckType = dns.TypeNS
+
+// healthCheckOptions of active probing, upstream failed in a row is taken out of selection until it recovers
+type healthCheckOptions struct {
+	// interval between probes, zero disables health check
+	interval time.Duration
+	name     string
+	qtype    uint16
+	// failures in a row to mark upstream unhealthy
+	failures int
+	// successes in a row to mark upstream healthy again
+	recoveries int
+}
+
+func newDefaultHealthCheckOptions() healthCheckOptions {
+	return healthCheckOptions{
+		name:       defaultHealthCheckName,
+		qtype:      defaultHealthCheckType,
+		failures:   defaultHealthCheckFailures,
+		recoveries: defaultHealthCheckRecoveries,
+	}
+}
+
+func (p *Plugin) startHealthCheck(logger *logrus.Entry, upstreams []*ups) {
+	if p.healthCheck.interval <= 0 {
+		return
+	}
+	for _, u := range upstreams {
+		logger := logger.WithFields(logrus.Fields{
+			"upstream": u.addr,
+			"net":      u.net,
+		})
+		go p.healthCheckLoop(u, logger)
+	}
+}
+
+func (p *Plugin) healthCheckLoop(u *ups, logger *logrus.Entry) {
+	var failures, successes int
+	ticker := time.NewTicker(p.healthCheck.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-u.done:
+			return
+		}
+		err := p.probe(u)
+		if err != nil {
+			failures++
+			successes = 0
+			logger.WithError(err).Debug("Health check failed")
+		} else {
+			successes++
+			failures = 0
+		}
+		switch unhealthy := u.unhealthy.Load(); {
+		case !unhealthy && failures >= p.healthCheck.failures:
+			u.unhealthy.Store(true)
+			logger.WithError(err).Warnf("Upstream is unhealthy after %d failed health checks", failures)
+		case unhealthy && successes >= p.healthCheck.recoveries:
+			u.unhealthy.Store(false)
+			logger.Infof("Upstream is healthy after %d successful health checks", successes)
+		}
+	}
+}
+
+// probe queries upstream with the health check question, any valid answer means upstream is working
+func (p *Plugin) probe(u *ups) error {
+	ctx, cancel := context.WithTimeout(context.Background(), p.healthCheck.interval)
+	defer cancel()
+	msg := new(dns.Msg)
+	msg.SetQuestion(p.healthCheck.name, p.healthCheck.qtype)
+	response, _, err := u.Exchange(ctx, msg)
+	if err != nil {
+		return err
+	}
+	if response == nil {
+		return errors.New("empty health check response")
+	}
+	if response.Rcode != dns.RcodeSuccess && response.Rcode != dns.RcodeNameError {
+		return fmt.Errorf("unexpected health check rcode: %s", dns.RcodeToString[response.Rcode])
+	}
+	return nil
+}
+
+// healthyUpstreams filters out unhealthy upstreams, all of them are returned if none is healthy
+func (p *Plugin) healthyUpstreams(upstreams []*ups) []*ups {
+	if p.healthCheck.interval <= 0 {
+		return upstreams
+	}
+	healthy := make([]*ups, 0, len(upstreams))
+	for _, u := range upstreams {
+		if !u.unhealthy.Load() {
+			healthy = append(healthy, u)
+		}
+	}
+	if len(healthy) == 0 {
+		return upstreams
+	}
+	return healthy
+}
@@ -1,6 +1,8 @@
 package upstream
 
 import (
+	"context"
+
 	"github.com/blho/apexdns/pkg/types"
 
 	"github.com/miekg/dns"
@@ -13,13 +15,51 @@ type Plugin struct {
 	tcpClient *dns.Client
 	tlsClient *dns.Client
 	upstreams []*ups
+	policy    policy
+	// parallel is the number of upstreams queried at once
+	parallel    int
+	hedge       *hedgeOptions
+	retry       retryOptions
+	retryOn     failureCondition
+	healthCheck healthCheckOptions
+	// resolvConf provides upstreams instead of the configured ones if set
+	resolvConf *resolvConfSource
 }
 
 func New() *Plugin {
-	return &Plugin{}
+	return &Plugin{
+		policy:      lowestLatencyPolicy{},
+		parallel:    1,
+		retry:       retryOptions{attempts: 1},
+		retryOn:     defaultFailureConditions,
+		healthCheck: newDefaultHealthCheckOptions(),
+	}
+}
+
+func (p *Plugin) initialize() {
+	upstreams, _, _ := p.getUpstreams()
+	p.startHealthCheck(p.logger, upstreams)
+	if p.resolvConf != nil {
+		// The logger is used by watcher only
+		logger := p.logger.WithField("resolvConf", p.resolvConf.path)
+		p.resolvConf.logger = logger
+		go p.resolvConf.watch(func(upstreams, previous []*ups) {
+			p.startHealthCheck(logger, upstreams)
+			for _, u := range previous {
+				u.close()
+			}
+		})
+	}
 }
 
-func (p *Plugin) initialize() {}
+// getUpstreams returns current upstreams with the policy and attempts for them
+func (p *Plugin) getUpstreams() ([]*ups, policy, int) {
+	if p.resolvConf != nil {
+		state := p.resolvConf.get()
+		return state.upstreams, state.policy, state.attempts
+	}
+	return p.upstreams, p.policy, p.retry.attempts
+}
 
 func (p *Plugin) Name() string {
 	return Name
@@ -28,30 +68,44 @@ func (p *Plugin) Name() string {
 func (p *Plugin) Tail(*types.Context) {}
 
 func (p *Plugin) Handle(ctx *types.Context) {
-	response, rtt, err := p.bestUpstream().Exchange(ctx.GetQueryMessage())
-	if err != nil {
-		p.logger.WithError(err).Error("Unable to exchange query")
-		ctx.AbortWithErr(err)
+	result := p.exchangeWithRetry(ctx, ctx.GetQueryMessage())
+	if result.err != nil {
+		p.logger.WithError(result.err).WithField("upstream", result.upstream.addr).Error("Unable to exchange query")
+		ctx.AbortWithErr(result.err)
 		return
 	}
-	ctx.GetLogger(p.logger).Debugf("Exchanged %s", rtt)
-	ctx.SetResponse(response)
+	upstream := result.upstream
+	ctx.GetLogger(p.logger).WithFields(logrus.Fields{
+		"upstream":  upstream.addr,
+		"srtt":      upstream.stats.getSRTT(),
+		"errorRate": upstream.stats.getErrorRate(),
+		"inflight":  upstream.stats.getInflight(),
+	}).Debugf("Exchanged %s", result.rtt)
+	ctx.SetResponse(result.response)
 }
 
-func (p *Plugin) bestUpstream() *ups {
-	best := 0
-	for i := 0; i < len(p.upstreams); i++ {
-		if p.upstreams[i].srtt < p.upstreams[best].srtt {
-			best = i
-		}
+// exchangeWithRetry moves to the next upstreams by score once the exchange is failed
+func (p *Plugin) exchangeWithRetry(ctx *types.Context, msg *dns.Msg) exchangeResult {
+	exchangeCtx := context.Background()
+	if p.retry.budget > 0 {
+		var cancel context.CancelFunc
+		exchangeCtx, cancel = context.WithTimeout(exchangeCtx, p.retry.budget)
+		defer cancel()
 	}
-	go func(selected int) { // lost decay
-		for i := 0; i < len(p.upstreams); i++ {
-			if i != selected {
-				p.upstreams[i].srttAttenuation()
-			}
+	upstreams, policy, attempts := p.getUpstreams()
+	upstreams = policy.order(p.healthyUpstreams(upstreams))
+	var (
+		result  exchangeResult
+		queried int
+	)
+	for attempt := 1; ; attempt++ {
+		result, queried = p.exchange(exchangeCtx, upstreams, msg)
+		if !p.retryOn.failed(result) || attempt >= attempts || exchangeCtx.Err() != nil {
+			return result
 		}
-	}(best)
-
-	return p.upstreams[best]
+		ctx.GetLogger(p.logger).WithError(result.err).WithField("upstream", result.upstream.addr).
+			Debugf("Attempt %d failed, retrying", attempt)
+		// Queried upstreams are moved to the end
+		upstreams = append(upstreams[queried:], upstreams[:queried]...)
+	}
 }
@@ -0,0 +1,121 @@
+package upstream
+
+import (
+	"fmt"
+	"math/rand"
+	"sort"
+	"sync/atomic"
+)
+
+const (
+	PolicyLowestLatency = "lowest_latency"
+	PolicyRoundRobin    = "round_robin"
+	PolicyRandom        = "random"
+	PolicyWeighted      = "weighted"
+	PolicySequential    = "sequential"
+
+	// Upstream is skipped by sequential policy if its error rate is higher
+	sequentialMaxErrorRate = 0.5
+)
+
+// policy decides which upstream should be used
+type policy interface {
+	// order returns upstreams in the order they should be tried, the first one is preferred
+	order(upstreams []*ups) []*ups
+}
+
+func newPolicy(name string) (policy, error) {
+	switch name {
+	case PolicyLowestLatency:
+		return lowestLatencyPolicy{}, nil
+	case PolicyRoundRobin:
+		return &roundRobinPolicy{}, nil
+	case PolicyRandom:
+		return randomPolicy{}, nil
+	case PolicyWeighted:
+		return weightedPolicy{}, nil
+	case PolicySequential:
+		return sequentialPolicy{}, nil
+	default:
+		return nil, fmt.Errorf("unknown upstream policy: %s", name)
+	}
+}
+
+// lowestLatencyPolicy prefers the upstream with lowest score, others decay so they'll be tried again
+type lowestLatencyPolicy struct{}
+
+func (lowestLatencyPolicy) order(upstreams []*ups) []*ups {
+	scores := make(map[*ups]float64, len(upstreams))
+	for _, u := range upstreams {
+		scores[u] = u.stats.score()
+	}
+	ordered := append([]*ups(nil), upstreams...)
+	sort.SliceStable(ordered, func(i, j int) bool {
+		return scores[ordered[i]] < scores[ordered[j]]
+	})
+	for _, u := range ordered[1:] {
+		u.stats.decay()
+	}
+	return ordered
+}
+
+type roundRobinPolicy struct {
+	next atomic.Uint64
+}
+
+func (p *roundRobinPolicy) order(upstreams []*ups) []*ups {
+	start := int(p.next.Add(1)-1) % len(upstreams)
+	return append(append([]*ups(nil), upstreams[start:]...), upstreams[:start]...)
+}
+
+type randomPolicy struct{}
+
+func (randomPolicy) order(upstreams []*ups) []*ups {
+	ordered := append([]*ups(nil), upstreams...)
+	rand.Shuffle(len(ordered), func(i, j int) {
+		ordered[i], ordered[j] = ordered[j], ordered[i]
+	})
+	return ordered
+}
+
+// weightedPolicy picks upstreams randomly in proportion to their weights
+type weightedPolicy struct{}
+
+func (weightedPolicy) order(upstreams []*ups) []*ups {
+	remaining := append([]*ups(nil), upstreams...)
+	total := 0
+	for _, u := range remaining {
+		total += u.weight
+	}
+	ordered := make([]*ups, 0, len(upstreams))
+	for len(remaining) > 0 {
+		n := rand.Intn(total)
+		for i, u := range remaining {
+			if n -= u.weight; n < 0 {
+				ordered = append(ordered, u)
+				total -= u.weight
+				remaining = append(remaining[:i], remaining[i+1:]...)
+				break
+			}
+		}
+	}
+	return ordered
+}
+
+// sequentialPolicy keeps the configured order, failing upstreams are moved to the end
+type sequentialPolicy struct{}
+
+func (sequentialPolicy) order(upstreams []*ups) []*ups {
+	ordered := make([]*ups, 0, len(upstreams))
+	var failing []*ups
+	for _, u := range upstreams {
+		if u.stats.getErrorRate() > sequentialMaxErrorRate {
+			// Decay so it will be tried again
+			u.stats.decay()
+			failing = append(failing, u)
+			continue
+		}
+		ordered = append(ordered, u)
+	}
+	return append(ordered, failing...)
+}
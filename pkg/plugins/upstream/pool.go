@@ -0,0 +1,367 @@
+package upstream
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"net"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+const (
+	defaultPoolSize        = 4
+	defaultPoolIdleTimeout = 10 * time.Second
+	// Query timeout of pooled connections if upstream has none
+	defaultPoolTimeout = 5 * time.Second
+)
+
+var errConnClosed = errors.New("upstream connection closed")
+
+type poolOptions struct {
+	// size limits persistent connections per upstream
+	size int
+	// idleTimeout closes the connection if no query within it
+	idleTimeout time.Duration
+}
+
+func newDefaultPoolOptions() poolOptions {
+	return poolOptions{
+		size:        defaultPoolSize,
+		idleTimeout: defaultPoolIdleTimeout,
+	}
+}
+
+// connPool keeps persistent stream connections to upstream, queries are pipelined on them
+type connPool struct {
+	dial    func(ctx context.Context) (net.Conn, error)
+	timeout time.Duration
+	opts    poolOptions
+	conns   []*pipelineConn
+	dialing int
+	lock    sync.Mutex
+	cond    *sync.Cond
+}
+
+func newConnPool(dial func(ctx context.Context) (net.Conn, error), timeout time.Duration, opts poolOptions) *connPool {
+	if timeout <= 0 {
+		timeout = defaultPoolTimeout
+	}
+	p := &connPool{
+		dial:    dial,
+		timeout: timeout,
+		opts:    opts,
+	}
+	p.cond = sync.NewCond(&p.lock)
+	return p
+}
+
+// get returns the least busy connection, a new one will be dialed if all of them are busy and pool is not full
+func (p *connPool) get(ctx context.Context) (*pipelineConn, bool, error) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	var best *pipelineConn
+	for {
+		best = p.leastBusy()
+		full := len(p.conns)+p.dialing >= p.opts.size
+		if best != nil && (best.inflight() == 0 || full) {
+			return best, true, nil
+		}
+		if best != nil || !full {
+			break
+		}
+		// Wait for connections being dialed
+		p.cond.Wait()
+	}
+	p.dialing++
+	p.lock.Unlock()
+	conn, err := p.dial(ctx)
+	p.lock.Lock()
+	p.dialing--
+	p.cond.Broadcast()
+	if err != nil {
+		if best != nil && best.usable() {
+			return best, true, nil
+		}
+		return nil, false, err
+	}
+	c := newPipelineConn(conn, p.timeout, p.opts.idleTimeout)
+	p.conns = append(p.conns, c)
+	return c, false, nil
+}
+
+// leastBusy removes closed connections and returns the one with fewest pending queries
+func (p *connPool) leastBusy() *pipelineConn {
+	var best *pipelineConn
+	alive := p.conns[:0]
+	for _, c := range p.conns {
+		if !c.usable() {
+			continue
+		}
+		alive = append(alive, c)
+		if best == nil || c.inflight() < best.inflight() {
+			best = c
+		}
+	}
+	p.conns = alive
+	return best
+}
+
+func (p *connPool) exchange(ctx context.Context, msg *dns.Msg) (*dns.Msg, time.Duration, error) {
+	c, reused, err := p.get(ctx)
+	if err != nil {
+		return nil, 0, err
+	}
+	response, rtt, err := c.exchange(ctx, msg, p.timeout)
+	if errors.Is(err, errConnClosed) && reused {
+		// Connection may be closed by upstream while idle, try again with a new one
+		if c, _, err = p.get(ctx); err != nil {
+			return nil, rtt, err
+		}
+		response, rtt, err = c.exchange(ctx, msg, p.timeout)
+	}
+	return response, rtt, err
+}
+
+// pipelineConn multiplexes queries on a connection by message ID
+type pipelineConn struct {
+	conn        *dns.Conn
+	writeLock   sync.Mutex
+	pending     map[uint16]chan *dns.Msg
+	idleTimeout time.Duration
+	// readTimeout is the query timeout, connection is considered dead if nothing is read within it
+	// while queries are pending
+	readTimeout time.Duration
+	// idleRead is set if the read deadline is the idle timeout
+	idleRead bool
+	// timedOut is set if a query timed out since the last read
+	timedOut bool
+	// expired is set if the connection is closed as upstream doesn't respond to pending queries
+	expired bool
+	closed  bool
+	// draining connection accepts no more queries, upstream asks to close it
+	draining bool
+	lock     sync.Mutex
+}
+
+func newPipelineConn(conn net.Conn, readTimeout, idleTimeout time.Duration) *pipelineConn {
+	c := &pipelineConn{
+		conn:        &dns.Conn{Conn: conn},
+		pending:     make(map[uint16]chan *dns.Msg),
+		idleTimeout: idleTimeout,
+		readTimeout: readTimeout,
+	}
+	go c.readLoop()
+	return c
+}
+
+func (c *pipelineConn) usable() bool {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return !c.closed && !c.draining
+}
+
+func (c *pipelineConn) inflight() int {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return len(c.pending)
+}
+
+// register allocates an unused message ID for the query
+func (c *pipelineConn) register() (uint16, chan *dns.Msg, error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.closed {
+		return 0, nil, errConnClosed
+	}
+	if len(c.pending) >= 0x10000 {
+		return 0, nil, errors.New("too many pending queries")
+	}
+	id := uint16(rand.Intn(0x10000))
+	for {
+		if _, exists := c.pending[id]; !exists {
+			break
+		}
+		id++
+	}
+	if len(c.pending) == 0 {
+		// Interrupt the idle read, upstream should respond in time now
+		c.conn.SetReadDeadline(time.Now().Add(c.readTimeout))
+		c.idleRead = false
+	}
+	ch := make(chan *dns.Msg, 1)
+	c.pending[id] = ch
+	return id, ch, nil
+}
+
+func (c *pipelineConn) unregister(id uint16, ch chan *dns.Msg) {
+	c.lock.Lock()
+	if c.pending[id] == ch {
+		delete(c.pending, id)
+	}
+	c.lock.Unlock()
+}
+
+func (c *pipelineConn) exchange(ctx context.Context, msg *dns.Msg, timeout time.Duration) (*dns.Msg, time.Duration, error) {
+	id, ch, err := c.register()
+	if err != nil {
+		return nil, 0, err
+	}
+	defer c.unregister(id, ch)
+	query := msg.Copy()
+	query.Id = id
+	opt := query.IsEdns0()
+	if opt == nil {
+		opt = query.SetEdns0(dns.MinMsgSize, false).IsEdns0()
+	}
+	// Ask upstream for idle timeout as RFC 7828 described
+	opt.Option = append(opt.Option, &dns.EDNS0_TCP_KEEPALIVE{Code: dns.EDNS0TCPKEEPALIVE})
+
+	startAt := time.Now()
+	c.writeLock.Lock()
+	c.conn.SetWriteDeadline(startAt.Add(timeout))
+	err = c.conn.WriteMsg(query)
+	c.writeLock.Unlock()
+	if err != nil {
+		c.close()
+		return nil, time.Since(startAt), fmt.Errorf("%w: %v", errConnClosed, err)
+	}
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case response, ok := <-ch:
+		rtt := time.Since(startAt)
+		if !ok {
+			c.lock.Lock()
+			expired := c.expired
+			c.lock.Unlock()
+			if expired {
+				return nil, rtt, os.ErrDeadlineExceeded
+			}
+			return nil, rtt, errConnClosed
+		}
+		stripKeepalive(response, msg.IsEdns0() != nil)
+		response.Id = msg.Id
+		return response, rtt, nil
+	case <-timer.C:
+		// Only the query times out, read loop closes the connection if upstream doesn't respond at all
+		c.lock.Lock()
+		c.timedOut = true
+		c.lock.Unlock()
+		return nil, time.Since(startAt), os.ErrDeadlineExceeded
+	case <-ctx.Done():
+		// Response of cancelled query will be dropped by read loop
+		return nil, time.Since(startAt), ctx.Err()
+	}
+}
+
+// applyKeepalive applies the idle timeout offered by upstream
+func (c *pipelineConn) applyKeepalive(response *dns.Msg) {
+	opt := response.IsEdns0()
+	if opt == nil {
+		return
+	}
+	for _, o := range opt.Option {
+		keepalive, ok := o.(*dns.EDNS0_TCP_KEEPALIVE)
+		if !ok {
+			continue
+		}
+		c.lock.Lock()
+		if keepalive.Timeout == 0 {
+			// Upstream wants the connection to be closed
+			c.draining = true
+		} else if timeout := time.Duration(keepalive.Timeout) * 100 * time.Millisecond; timeout < c.idleTimeout {
+			c.idleTimeout = timeout
+		}
+		c.lock.Unlock()
+	}
+}
+
+// stripKeepalive removes the hop-by-hop option, and the OPT record if query doesn't carry one
+func stripKeepalive(response *dns.Msg, keepOPT bool) {
+	opt := response.IsEdns0()
+	if opt == nil {
+		return
+	}
+	if !keepOPT {
+		removeOPT(response)
+		return
+	}
+	options := opt.Option[:0]
+	for _, o := range opt.Option {
+		if o.Option() != dns.EDNS0TCPKEEPALIVE {
+			options = append(options, o)
+		}
+	}
+	opt.Option = options
+}
+
+// removeOPT removes OPT record from response
+func removeOPT(response *dns.Msg) {
+	extra := response.Extra[:0]
+	for _, rr := range response.Extra {
+		if rr.Header().Rrtype != dns.TypeOPT {
+			extra = append(extra, rr)
+		}
+	}
+	response.Extra = extra
+}
+
+func (c *pipelineConn) readLoop() {
+	defer c.close()
+	for {
+		c.lock.Lock()
+		if c.draining && len(c.pending) == 0 {
+			c.lock.Unlock()
+			return
+		}
+		c.idleRead = len(c.pending) == 0
+		if c.idleRead {
+			c.conn.SetReadDeadline(time.Now().Add(c.idleTimeout))
+		} else {
+			c.conn.SetReadDeadline(time.Now().Add(c.readTimeout))
+		}
+		c.lock.Unlock()
+		response, err := c.conn.ReadMsg()
+		if err != nil {
+			c.lock.Lock()
+			// Pending queries are cancelled before upstream responds, the connection is idle now
+			keep := isTimeout(err) && !c.idleRead && !c.timedOut && len(c.pending) == 0 && !c.closed
+			c.expired = isTimeout(err) && len(c.pending) > 0
+			c.lock.Unlock()
+			if keep {
+				continue
+			}
+			// Idle, or upstream doesn't respond to pending queries at all
+			return
+		}
+		c.applyKeepalive(response)
+		c.lock.Lock()
+		c.timedOut = false
+		ch, ok := c.pending[response.Id]
+		delete(c.pending, response.Id)
+		c.lock.Unlock()
+		if ok {
+			ch <- response
+		}
+	}
+}
+
+func (c *pipelineConn) close() {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.closed {
+		return
+	}
+	c.closed = true
+	c.conn.Close()
+	for id, ch := range c.pending {
+		close(ch)
+		delete(c.pending, id)
+	}
+}
@@ -0,0 +1,124 @@
+package upstream
+
+import (
+	"context"
+	"net"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// startPoolTestServer starts a DNS server over TCP, queries of names starting with "hang" are never answered
+func startPoolTestServer(t *testing.T, delay time.Duration) (string, *atomic.Int32) {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	accepted := new(atomic.Int32)
+	started := make(chan struct{})
+	server := &dns.Server{
+		Listener:          &countingListener{Listener: ln, accepted: accepted},
+		NotifyStartedFunc: func() { close(started) },
+		Handler: dns.HandlerFunc(func(w dns.ResponseWriter, r *dns.Msg) {
+			if strings.HasPrefix(r.Question[0].Name, "hang") {
+				return
+			}
+			time.Sleep(delay)
+			response := new(dns.Msg)
+			response.SetReply(r)
+			w.WriteMsg(response)
+		}),
+	}
+	go server.ActivateAndServe()
+	<-started
+	t.Cleanup(func() {
+		server.Shutdown()
+	})
+	return ln.Addr().String(), accepted
+}
+
+type countingListener struct {
+	net.Listener
+	accepted *atomic.Int32
+}
+
+func (l *countingListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err == nil {
+		l.accepted.Add(1)
+	}
+	return conn, err
+}
+
+func newPoolTestPool(addr string, timeout time.Duration) *connPool {
+	dial := func(ctx context.Context) (net.Conn, error) {
+		return new(net.Dialer).DialContext(ctx, "tcp", addr)
+	}
+	return newConnPool(dial, timeout, poolOptions{size: 1, idleTimeout: 10 * time.Second})
+}
+
+func exchangePool(ctx context.Context, p *connPool, name string) error {
+	msg := new(dns.Msg)
+	msg.SetQuestion(name, dns.TypeA)
+	_, _, err := p.exchange(ctx, msg)
+	return err
+}
+
+func TestPoolSlowResponseWithinTimeout(t *testing.T) {
+	addr, accepted := startPoolTestServer(t, 300*time.Millisecond)
+	p := newPoolTestPool(addr, time.Second)
+	if err := exchangePool(context.Background(), p, "example.com."); err != nil {
+		t.Fatalf("exchange failed: %v", err)
+	}
+	if n := accepted.Load(); n != 1 {
+		t.Errorf("expect 1 connection, got %d", n)
+	}
+}
+
+func TestPoolCancelledQueryKeepsConnection(t *testing.T) {
+	addr, accepted := startPoolTestServer(t, 0)
+	p := newPoolTestPool(addr, 100*time.Millisecond)
+	if err := exchangePool(context.Background(), p, "example.com."); err != nil {
+		t.Fatalf("exchange failed: %v", err)
+	}
+
+	// Cancelled query leaves the read deadline of pending queries armed
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if err := exchangePool(ctx, p, "hang.example.com."); err != context.DeadlineExceeded {
+		t.Fatalf("expect %v, got %v", context.DeadlineExceeded, err)
+	}
+	time.Sleep(300 * time.Millisecond)
+
+	// Connection idle after the deadline is still in use
+	if c := p.conns[0]; !c.usable() {
+		t.Fatal("idle connection is closed after the cancelled query")
+	}
+	if err := exchangePool(context.Background(), p, "example.com."); err != nil {
+		t.Fatalf("exchange failed: %v", err)
+	}
+	if n := accepted.Load(); n != 1 {
+		t.Errorf("expect 1 connection, got %d", n)
+	}
+}
+
+func TestPoolDeadConnection(t *testing.T) {
+	addr, accepted := startPoolTestServer(t, 0)
+	p := newPoolTestPool(addr, 100*time.Millisecond)
+
+	// Connection is closed if upstream doesn't respond to pending query within timeout
+	if err := exchangePool(context.Background(), p, "hang.example.com."); !isTimeout(err) {
+		t.Fatalf("expect timeout, got %v", err)
+	}
+	time.Sleep(200 * time.Millisecond)
+	if err := exchangePool(context.Background(), p, "example.com."); err != nil {
+		t.Fatalf("exchange failed: %v", err)
+	}
+	if n := accepted.Load(); n != 2 {
+		t.Errorf("expect 2 connections, got %d", n)
+	}
+}
@@ -0,0 +1,222 @@
+package upstream
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// Defaults and limits follow resolv.conf(5)
+	defaultResolvConfTimeout  = 5 * time.Second
+	defaultResolvConfAttempts = 2
+	resolvConfMaxNameservers  = 3
+	resolvConfMaxTimeout      = 30
+	resolvConfMaxAttempts     = 5
+
+	// resolvConfCheckInterval limits how often the file is checked
+	resolvConfCheckInterval = 2 * time.Second
+)
+
+// resolvConf is the resolver config read from a resolv.conf file.
+// Search domains are kept for logging only, queries from stub resolvers are already expanded so names are forwarded as is.
+type resolvConf struct {
+	nameservers []string
+	search      []string
+	timeout     time.Duration
+	attempts    int
+	rotate      bool
+}
+
+func parseResolvConf(r io.Reader) (*resolvConf, error) {
+	conf := &resolvConf{
+		timeout:  defaultResolvConfTimeout,
+		attempts: defaultResolvConfAttempts,
+	}
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if i := strings.IndexAny(line, "#;"); i >= 0 {
+			line = line[:i]
+		}
+		fields := strings.Fields(line)
+		if len(fields) < 2 {
+			continue
+		}
+		switch fields[0] {
+		case "nameserver":
+			if len(conf.nameservers) >= resolvConfMaxNameservers {
+				continue
+			}
+			// Strip IPv6 zone for validation only, it's kept in address
+			if net.ParseIP(strings.SplitN(fields[1], "%", 2)[0]) == nil {
+				continue
+			}
+			conf.nameservers = append(conf.nameservers, fields[1])
+		case "domain":
+			conf.search = []string{dns.Fqdn(fields[1])}
+		case "search":
+			// The last one wins
+			conf.search = conf.search[:0]
+			for _, domain := range fields[1:] {
+				conf.search = append(conf.search, dns.Fqdn(domain))
+			}
+		case "options":
+			for _, option := range fields[1:] {
+				parseResolvConfOption(conf, option)
+			}
+		}
+	}
+	return conf, scanner.Err()
+}
+
+// parseResolvConfOption applies the option, unknown or invalid options are ignored as libc does
+func parseResolvConfOption(conf *resolvConf, option string) {
+	if option == "rotate" {
+		conf.rotate = true
+		return
+	}
+	kv := strings.SplitN(option, ":", 2)
+	if len(kv) != 2 {
+		return
+	}
+	value, err := strconv.Atoi(kv[1])
+	if err != nil || value < 0 {
+		return
+	}
+	switch kv[0] {
+	case "timeout":
+		conf.timeout = time.Duration(max(min(value, resolvConfMaxTimeout), 1)) * time.Second
+	case "attempts":
+		conf.attempts = max(min(value, resolvConfMaxAttempts), 1)
+	}
+}
+
+// resolvConfSource builds upstreams from a resolv.conf file, they are rebuilt once the file changes
+type resolvConfSource struct {
+	path string
+	// timeout, policy and attempts override the ones of resolv.conf if set
+	timeout  time.Duration
+	policy   policy
+	attempts int
+	logger   *logrus.Entry
+	modTime  time.Time
+	state    atomic.Pointer[resolvConfState]
+}
+
+// resolvConfState is the snapshot of upstreams built from resolv.conf
+type resolvConfState struct {
+	conf      *resolvConf
+	upstreams []*ups
+	policy    policy
+	attempts  int
+}
+
+func newResolvConfSource(path string) *resolvConfSource {
+	return &resolvConfSource{path: path}
+}
+
+// load reads the file, upstreams are rebuilt if config is changed
+func (s *resolvConfSource) load() (bool, error) {
+	info, err := os.Stat(s.path)
+	if err != nil {
+		return false, err
+	}
+	f, err := os.Open(s.path)
+	if err != nil {
+		return false, err
+	}
+	defer f.Close()
+	conf, err := parseResolvConf(f)
+	if err != nil {
+		return false, err
+	}
+	s.modTime = info.ModTime()
+	if len(conf.nameservers) == 0 {
+		return false, fmt.Errorf("no nameserver in %s", s.path)
+	}
+	if current := s.state.Load(); current != nil && reflect.DeepEqual(current.conf, conf) {
+		return false, nil
+	}
+	state, err := s.build(conf)
+	if err != nil {
+		return false, err
+	}
+	s.state.Store(state)
+	return true, nil
+}
+
+func (s *resolvConfSource) build(conf *resolvConf) (*resolvConfState, error) {
+	state := &resolvConfState{
+		conf:     conf,
+		policy:   s.policy,
+		attempts: s.attempts,
+	}
+	timeout := s.timeout
+	if timeout == 0 {
+		timeout = conf.timeout
+	}
+	for _, nameserver := range conf.nameservers {
+		opts := upstreamOptions{pool: newDefaultPoolOptions(), weight: 1, udpSize: defaultUDPSize}
+		u, err := newUpstream("udp", net.JoinHostPort(nameserver, "53"), opts, timeout)
+		if err != nil {
+			return nil, err
+		}
+		state.upstreams = append(state.upstreams, u)
+	}
+	if state.policy == nil {
+		// Nameservers are tried in order unless rotate is set
+		state.policy = sequentialPolicy{}
+		if conf.rotate {
+			state.policy = &roundRobinPolicy{}
+		}
+	}
+	if state.attempts == 0 {
+		// Each nameserver is tried `attempts` times
+		state.attempts = conf.attempts * len(state.upstreams)
+	}
+	return state, nil
+}
+
+func (s *resolvConfSource) get() *resolvConfState {
+	return s.state.Load()
+}
+
+// watch checks modification time of the file and rebuilds upstreams once it's changed, onChange is called
+// with new and old upstreams
+func (s *resolvConfSource) watch(onChange func(upstreams, previous []*ups)) {
+	ticker := time.NewTicker(resolvConfCheckInterval)
+	defer ticker.Stop()
+	for range ticker.C {
+		info, err := os.Stat(s.path)
+		if err != nil || info.ModTime().Equal(s.modTime) {
+			continue
+		}
+		previous := s.get()
+		changed, err := s.load()
+		if err != nil {
+			// Keep the current upstreams, e.g. there is no nameserver while network is down
+			s.logger.WithError(err).Warn("Unable to reload resolv.conf")
+			continue
+		}
+		if !changed {
+			continue
+		}
+		current := s.get()
+		s.logger.WithFields(logrus.Fields{
+			"nameservers": current.conf.nameservers,
+			"search":      current.conf.search,
+		}).Info("Reloaded upstreams from resolv.conf")
+		onChange(current.upstreams, previous.upstreams)
+	}
+}
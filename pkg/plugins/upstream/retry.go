@@ -0,0 +1,83 @@
+package upstream
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// failureCondition decides whether an exchange is failed and worth retrying
+type failureCondition uint8
+
+const (
+	failOnNetworkError failureCondition = 1 << iota
+	failOnTimeout
+	failOnServfail
+	failOnRefused
+	failOnEmpty
+
+	defaultFailureConditions = failOnNetworkError | failOnTimeout | failOnServfail | failOnRefused
+)
+
+var failureConditionNames = map[string]failureCondition{
+	"network_error": failOnNetworkError,
+	"timeout":       failOnTimeout,
+	"servfail":      failOnServfail,
+	"refused":       failOnRefused,
+	"empty":         failOnEmpty,
+}
+
+func parseFailureConditions(names []string) (failureCondition, error) {
+	var conditions failureCondition
+	for _, name := range names {
+		condition, ok := failureConditionNames[name]
+		if !ok {
+			return 0, fmt.Errorf("unknown retry condition: %s", name)
+		}
+		conditions |= condition
+	}
+	return conditions, nil
+}
+
+// failed reports whether the result matches any of conditions
+func (c failureCondition) failed(r exchangeResult) bool {
+	if r.err != nil {
+		if isTimeout(r.err) {
+			return c&failOnTimeout != 0
+		}
+		return c&failOnNetworkError != 0
+	}
+	if r.response == nil {
+		return true
+	}
+	switch r.response.Rcode {
+	case dns.RcodeServerFailure:
+		return c&failOnServfail != 0
+	case dns.RcodeRefused:
+		return c&failOnRefused != 0
+	case dns.RcodeSuccess:
+		return c&failOnEmpty != 0 && len(r.response.Answer) == 0
+	}
+	return false
+}
+
+func isTimeout(err error) bool {
+	if errors.Is(err, context.DeadlineExceeded) || errors.Is(err, os.ErrDeadlineExceeded) {
+		return true
+	}
+	var netErr net.Error
+	return errors.As(err, &netErr) && netErr.Timeout()
+}
+
+// retryOptions of failed exchanges
+type retryOptions struct {
+	// attempts is the max number of exchanges for a query, including the first one
+	attempts int
+	// budget limits the total time of all attempts, zero means unlimited
+	budget time.Duration
+}
@@ -0,0 +1,218 @@
+package upstream
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/blho/apexdns/pkg/types"
+
+	"github.com/miekg/dns"
+	"github.com/sirupsen/logrus"
+)
+
+func TestFailureConditions(t *testing.T) {
+	response := func(rcode int, answers int) *dns.Msg {
+		msg := new(dns.Msg)
+		msg.SetRcode(newTestQuery(), rcode)
+		for i := 0; i < answers; i++ {
+			rr, _ := dns.NewRR("example.com. 60 IN A 10.0.0.1")
+			msg.Answer = append(msg.Answer, rr)
+		}
+		return msg
+	}
+	var (
+		refusedErr = &net.OpError{Op: "read", Net: "udp", Err: os.NewSyscallError("recvfrom", syscall.ECONNREFUSED)}
+		timeoutErr = &net.OpError{Op: "read", Net: "udp", Err: os.ErrDeadlineExceeded}
+	)
+	for _, c := range []struct {
+		name       string
+		conditions failureCondition
+		result     exchangeResult
+		failed     bool
+	}{
+		{"timeout", failOnTimeout, exchangeResult{err: timeoutErr}, true},
+		{"context timeout", failOnTimeout, exchangeResult{err: context.DeadlineExceeded}, true},
+		{"timeout is not network error", failOnNetworkError, exchangeResult{err: timeoutErr}, false},
+		{"network error", failOnNetworkError, exchangeResult{err: refusedErr}, true},
+		{"network error is not timeout", failOnTimeout, exchangeResult{err: refusedErr}, false},
+		{"unexpected EOF", failOnNetworkError, exchangeResult{err: io.ErrUnexpectedEOF}, true},
+		{"servfail", failOnServfail, exchangeResult{response: response(dns.RcodeServerFailure, 0)}, true},
+		{"servfail not in conditions", failOnRefused, exchangeResult{response: response(dns.RcodeServerFailure, 0)}, false},
+		{"refused", failOnRefused, exchangeResult{response: response(dns.RcodeRefused, 0)}, true},
+		{"refused not in conditions", failOnServfail, exchangeResult{response: response(dns.RcodeRefused, 0)}, false},
+		{"empty", failOnEmpty, exchangeResult{response: response(dns.RcodeSuccess, 0)}, true},
+		{"empty not in conditions", defaultFailureConditions, exchangeResult{response: response(dns.RcodeSuccess, 0)}, false},
+		{"answered", failOnEmpty, exchangeResult{response: response(dns.RcodeSuccess, 1)}, false},
+		{"nxdomain is not empty", failOnEmpty, exchangeResult{response: response(dns.RcodeNameError, 0)}, false},
+		{"no response", 0, exchangeResult{}, true},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			if failed := c.conditions.failed(c.result); failed != c.failed {
+				t.Errorf("expect failed %v, got %v", c.failed, failed)
+			}
+		})
+	}
+}
+
+func TestExchangeWithRetry(t *testing.T) {
+	var (
+		servfail = testBehavior{rcode: dns.RcodeServerFailure}
+		answered = testBehavior{}
+	)
+	for _, c := range []struct {
+		name      string
+		parallel  int
+		retry     retryOptions
+		retryOn   failureCondition
+		timeout   time.Duration
+		behaviors []testBehavior
+		// rcode of the final response, -1 if exchange fails with error
+		rcode int
+		// queries received by each upstream
+		queries []int
+	}{
+		{
+			name:      "retry servfail on next upstream",
+			retry:     retryOptions{attempts: 2},
+			retryOn:   defaultFailureConditions,
+			behaviors: []testBehavior{servfail, answered},
+			rcode:     dns.RcodeSuccess,
+			queries:   []int{1, 1},
+		},
+		{
+			name:      "retry refused on next upstream",
+			retry:     retryOptions{attempts: 2},
+			retryOn:   failOnRefused,
+			behaviors: []testBehavior{{rcode: dns.RcodeRefused}, answered},
+			rcode:     dns.RcodeSuccess,
+			queries:   []int{1, 1},
+		},
+		{
+			name:      "no retry if condition is not matched",
+			retry:     retryOptions{attempts: 2},
+			retryOn:   failOnTimeout,
+			behaviors: []testBehavior{servfail, answered},
+			rcode:     dns.RcodeServerFailure,
+			queries:   []int{1, 0},
+		},
+		{
+			name:      "retry empty answer",
+			retry:     retryOptions{attempts: 2},
+			retryOn:   failOnEmpty,
+			behaviors: []testBehavior{{empty: true}, answered},
+			rcode:     dns.RcodeSuccess,
+			queries:   []int{1, 1},
+		},
+		{
+			name:      "retry on timeout",
+			retry:     retryOptions{attempts: 2},
+			retryOn:   failOnTimeout,
+			timeout:   100 * time.Millisecond,
+			behaviors: []testBehavior{{drop: true}, answered},
+			rcode:     dns.RcodeSuccess,
+			queries:   []int{1, 1},
+		},
+		{
+			name:      "timeout is not retried as network error",
+			retry:     retryOptions{attempts: 2},
+			retryOn:   failOnNetworkError,
+			timeout:   100 * time.Millisecond,
+			behaviors: []testBehavior{{drop: true}, answered},
+			rcode:     -1,
+			queries:   []int{1, 0},
+		},
+		{
+			name:      "retry on network error",
+			retry:     retryOptions{attempts: 2},
+			retryOn:   failOnNetworkError,
+			behaviors: []testBehavior{{closed: true}, answered},
+			rcode:     dns.RcodeSuccess,
+			queries:   []int{0, 1},
+		},
+		{
+			name:      "network error is not retried as timeout",
+			retry:     retryOptions{attempts: 2},
+			retryOn:   failOnTimeout,
+			behaviors: []testBehavior{{closed: true}, answered},
+			rcode:     -1,
+			queries:   []int{0, 0},
+		},
+		{
+			name:      "attempts exhausted",
+			retry:     retryOptions{attempts: 2},
+			retryOn:   defaultFailureConditions,
+			behaviors: []testBehavior{servfail, servfail, answered},
+			rcode:     dns.RcodeServerFailure,
+			queries:   []int{1, 1, 0},
+		},
+		{
+			name:      "budget cuts off attempts",
+			retry:     retryOptions{attempts: 4, budget: 150 * time.Millisecond},
+			retryOn:   defaultFailureConditions,
+			timeout:   100 * time.Millisecond,
+			behaviors: []testBehavior{{drop: true}, {drop: true}, answered, answered},
+			rcode:     -1,
+			queries:   []int{1, 1, 0, 0},
+		},
+		{
+			name:      "queried upstreams move to the back",
+			parallel:  2,
+			retry:     retryOptions{attempts: 2},
+			retryOn:   defaultFailureConditions,
+			behaviors: []testBehavior{servfail, servfail, servfail},
+			rcode:     dns.RcodeServerFailure,
+			queries:   []int{2, 1, 1},
+		},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			timeout := c.timeout
+			if timeout == 0 {
+				timeout = time.Second
+			}
+			servers, upstreams := startTestUpstreams(t, c.behaviors, timeout)
+			logger := logrus.New()
+			logger.SetOutput(io.Discard)
+			p := New()
+			p.logger = logrus.NewEntry(logger)
+			p.upstreams = upstreams
+			// Keep the configured order
+			p.policy = sequentialPolicy{}
+			if c.parallel > 0 {
+				p.parallel = c.parallel
+			}
+			p.retry = c.retry
+			p.retryOn = c.retryOn
+
+			query := newTestQuery()
+			startAt := time.Now()
+			result := p.exchangeWithRetry(types.NewContext(net.IPv4(127, 0, 0, 1), query), query)
+			elapsed := time.Since(startAt)
+			if c.rcode < 0 {
+				if result.err == nil {
+					t.Errorf("expect error, got response %v", result.response)
+				}
+			} else if result.err != nil || result.response == nil || result.response.Rcode != c.rcode {
+				t.Errorf("expect %s, got response %v error %v", dns.RcodeToString[c.rcode], result.response, result.err)
+			}
+			if c.retry.budget > 0 {
+				if !errors.Is(result.err, context.DeadlineExceeded) {
+					t.Errorf("expect budget exceeded, got %v", result.err)
+				}
+				if elapsed > c.retry.budget+50*time.Millisecond {
+					t.Errorf("expect to return within budget %s, took %s", c.retry.budget, elapsed)
+				}
+			}
+			for i, server := range servers {
+				if queries := len(server.getQueries()); queries != c.queries[i] {
+					t.Errorf("expect %d queries to upstream %d, got %d", c.queries[i], i, queries)
+				}
+			}
+		})
+	}
+}
@@ -3,10 +3,16 @@ package upstream
 import (
 	"errors"
 	"fmt"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/blho/apexdns/pkg/server"
 	"github.com/blho/apexdns/pkg/types"
+
+	"github.com/miekg/dns"
 )
 
 const (
@@ -28,7 +34,10 @@ func parse(conf types.PluginConfig) (*Plugin, error) {
 		return nil, errors.New("invalid plugin config")
 	}
 	var (
-		plug = New()
+		plug      = New()
+		bootstrap *bootstrapResolver
+		// Explicit policy and retry override the ones of resolv.conf
+		policySet, retrySet bool
 	)
 	plug.logger = conf.Logger.WithField("plugin", Name)
 	args := conf.RemainingArgs()
@@ -43,7 +52,7 @@ func parse(conf types.PluginConfig) (*Plugin, error) {
 	}
 	for conf.NextBlock() {
 		switch kind := conf.Val(); kind {
-		case "tcp", "udp", "tcp-tls":
+		case "tcp", "udp", "tcp-tls", "https", "quic", "dnscrypt":
 			args := conf.RemainingArgs()
 			plug.logger.Infof("Adding %s upstream: %v", kind, args)
 			upstream, err := parseUpstreamArgs(kind, args, upstreamTimeout)
@@ -51,10 +60,151 @@ func parse(conf types.PluginConfig) (*Plugin, error) {
 				return nil, err
 			}
 			plug.upstreams = append(plug.upstreams, upstream)
+		case "policy":
+			args := conf.RemainingArgs()
+			if len(args) != 1 {
+				return nil, fmt.Errorf("invalid policy arguments: %v", args)
+			}
+			policy, err := newPolicy(args[0])
+			if err != nil {
+				return nil, err
+			}
+			plug.policy = policy
+			policySet = true
+		case "parallel":
+			args := conf.RemainingArgs()
+			if len(args) != 1 {
+				return nil, fmt.Errorf("invalid parallel arguments: %v", args)
+			}
+			parallel, err := strconv.Atoi(args[0])
+			if err != nil || parallel <= 0 {
+				return nil, fmt.Errorf("invalid parallel: %s", args[0])
+			}
+			plug.parallel = parallel
+		case "hedge":
+			// hedge percentile [max]
+			args := conf.RemainingArgs()
+			if len(args) != 1 && len(args) != 2 {
+				return nil, fmt.Errorf("invalid hedge arguments: %v", args)
+			}
+			hedge := &hedgeOptions{max: defaultHedgeMax}
+			percentile, err := strconv.ParseFloat(args[0], 64)
+			if err != nil || percentile <= 0 || percentile > 100 {
+				return nil, fmt.Errorf("invalid hedge percentile: %s", args[0])
+			}
+			hedge.percentile = percentile
+			if len(args) == 2 {
+				if hedge.max, err = strconv.Atoi(args[1]); err != nil || hedge.max < 2 {
+					return nil, fmt.Errorf("invalid hedge max upstreams: %s", args[1])
+				}
+			}
+			plug.hedge = hedge
+		case "retry":
+			// retry attempts [budget]
+			args := conf.RemainingArgs()
+			if len(args) != 1 && len(args) != 2 {
+				return nil, fmt.Errorf("invalid retry arguments: %v", args)
+			}
+			attempts, err := strconv.Atoi(args[0])
+			if err != nil || attempts <= 0 {
+				return nil, fmt.Errorf("invalid retry attempts: %s", args[0])
+			}
+			plug.retry.attempts = attempts
+			retrySet = true
+			if len(args) == 2 {
+				budget, err := time.ParseDuration(args[1])
+				if err != nil || budget <= 0 {
+					return nil, fmt.Errorf("invalid retry budget: %s", args[1])
+				}
+				plug.retry.budget = budget
+			}
+		case "retry_on":
+			args := conf.RemainingArgs()
+			if len(args) == 0 {
+				return nil, errors.New("retry_on requires at least one condition")
+			}
+			conditions, err := parseFailureConditions(args)
+			if err != nil {
+				return nil, err
+			}
+			plug.retryOn = conditions
+		case "health_check":
+			// health_check interval [name [type]]
+			args := conf.RemainingArgs()
+			if len(args) == 0 || len(args) > 3 {
+				return nil, fmt.Errorf("invalid health_check arguments: %v", args)
+			}
+			interval, err := time.ParseDuration(args[0])
+			if err != nil || interval <= 0 {
+				return nil, fmt.Errorf("invalid health_check interval: %s", args[0])
+			}
+			plug.healthCheck.interval = interval
+			if len(args) > 1 {
+				plug.healthCheck.name = dns.Fqdn(args[1])
+			}
+			if len(args) > 2 {
+				qtype, ok := dns.StringToType[strings.ToUpper(args[2])]
+				if !ok {
+					return nil, fmt.Errorf("invalid health_check type: %s", args[2])
+				}
+				plug.healthCheck.qtype = qtype
+			}
+		case "health_threshold":
+			// health_threshold failures recoveries
+			args := conf.RemainingArgs()
+			if len(args) != 2 {
+				return nil, fmt.Errorf("invalid health_threshold arguments: %v", args)
+			}
+			failures, err := strconv.Atoi(args[0])
+			if err != nil || failures <= 0 {
+				return nil, fmt.Errorf("invalid health_threshold failures: %s", args[0])
+			}
+			recoveries, err := strconv.Atoi(args[1])
+			if err != nil || recoveries <= 0 {
+				return nil, fmt.Errorf("invalid health_threshold recoveries: %s", args[1])
+			}
+			plug.healthCheck.failures = failures
+			plug.healthCheck.recoveries = recoveries
+		case "bootstrap":
+			args := conf.RemainingArgs()
+			if len(args) == 0 {
+				return nil, errors.New("bootstrap requires at least one server")
+			}
+			resolver, err := newBootstrapResolver(args)
+			if err != nil {
+				return nil, err
+			}
+			bootstrap = resolver
+		case "resolv_conf":
+			args := conf.RemainingArgs()
+			if len(args) != 1 {
+				return nil, fmt.Errorf("invalid resolv_conf arguments: %v", args)
+			}
+			plug.resolvConf = newResolvConfSource(args[0])
 		default:
 			return nil, fmt.Errorf("unknown config in upstream: %s %v", conf.Val(), conf.RemainingArgs())
 		}
 	}
+	if plug.resolvConf != nil {
+		if len(plug.upstreams) > 0 {
+			return nil, errors.New("resolv_conf can't be used with other upstreams")
+		}
+		plug.resolvConf.timeout = upstreamTimeout
+		if policySet {
+			plug.resolvConf.policy = plug.policy
+		}
+		if retrySet {
+			plug.resolvConf.attempts = plug.retry.attempts
+		}
+		if _, err := plug.resolvConf.load(); err != nil {
+			return nil, err
+		}
+	} else if len(plug.upstreams) == 0 {
+		return nil, errors.New("no upstream is configured")
+	}
+	for _, upstream := range plug.upstreams {
+		upstream.bootstrap = bootstrap
+	}
 
 	plug.initialize()
 	plug.logger.Info("Initialized upstream plugin")
@@ -62,17 +212,122 @@ func parse(conf types.PluginConfig) (*Plugin, error) {
 }
 
 func parseUpstreamArgs(kind string, args []string, timeout time.Duration) (*ups, error) {
-	// args upstreamAddr [socks5Addr]
+	// args upstreamAddr [socks5Addr] [key=value]...
 	if len(args) == 0 {
 		return nil, errors.New("upstream is required")
 	}
-	// TODO(@oif): Check address format <IP>:<Port>
 	var (
-		upstreamAddr    = args[0]
-		socks5ProxyAddr string
+		upstreamAddr = args[0]
+		opts         = upstreamOptions{pool: newDefaultPoolOptions(), weight: 1, udpSize: defaultUDPSize}
 	)
-	if len(args) == 2 {
-		socks5ProxyAddr = args[1]
+	for i, arg := range args[1:] {
+		kv := strings.SplitN(arg, "=", 2)
+		if len(kv) == 1 {
+			if i != 0 {
+				return nil, fmt.Errorf("invalid upstream option: %s", arg)
+			}
+			// Positional SOCKS5 proxy address
+			opts.socks5ProxyAddr = arg
+			continue
+		}
+		switch key, value := kv[0], kv[1]; key {
+		case "socks5":
+			opts.socks5ProxyAddr = value
+		case "server_name":
+			opts.tls.ServerName = value
+		case "ca":
+			opts.tls.CAFile = value
+		case "pin":
+			opts.tls.Pins = append(opts.tls.Pins, value)
+		case "method":
+			// DoH request method
+			switch strings.ToUpper(value) {
+			case "GET":
+				opts.doh.useGET = true
+			case "POST":
+				opts.doh.useGET = false
+			default:
+				return nil, fmt.Errorf("invalid DoH method: %s", value)
+			}
+		case "json_fallback":
+			if value != "on" && value != "off" {
+				return nil, fmt.Errorf("invalid json_fallback: %s", value)
+			}
+			opts.doh.jsonFallback = value == "on"
+		case "weight":
+			weight, err := strconv.Atoi(value)
+			if err != nil || weight <= 0 {
+				return nil, fmt.Errorf("invalid weight: %s", value)
+			}
+			opts.weight = weight
+		case "pool_size":
+			size, err := strconv.Atoi(value)
+			if err != nil || size <= 0 {
+				return nil, fmt.Errorf("invalid pool_size: %s", value)
+			}
+			opts.pool.size = size
+		case "idle_timeout":
+			timeout, err := time.ParseDuration(value)
+			if err != nil || timeout <= 0 {
+				return nil, fmt.Errorf("invalid idle_timeout: %s", value)
+			}
+			opts.pool.idleTimeout = timeout
+		case "udp_size":
+			size, err := strconv.ParseUint(value, 10, 16)
+			if err != nil || size < dns.MinMsgSize {
+				return nil, fmt.Errorf("invalid udp_size: %s", value)
+			}
+			opts.udpSize = uint16(size)
+		case "source":
+			ip := net.ParseIP(value)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid source IP: %s", value)
+			}
+			opts.dial.sourceIP = ip
+		case "interface":
+			opts.dial.iface = value
+		case "mark":
+			mark, err := strconv.ParseUint(value, 0, 32)
+			if err != nil {
+				return nil, fmt.Errorf("invalid mark: %s", value)
+			}
+			opts.dial.mark = uint32(mark)
+		case "tfo":
+			if value != "on" && value != "off" {
+				return nil, fmt.Errorf("invalid tfo: %s", value)
+			}
+			opts.dial.tfo = value == "on"
+		default:
+			return nil, fmt.Errorf("unknown upstream option: %s", arg)
+		}
+	}
+	if err := validateUpstreamAddr(kind, upstreamAddr); err != nil {
+		return nil, err
+	}
+	return newUpstream(kind, upstreamAddr, opts, timeout)
+}
+
+// validateUpstreamAddr checks address format, <Host>:<Port> for most kinds, URL for https and stamp for dnscrypt.
+// Host could be IP or hostname which is resolved by bootstrap servers.
+func validateUpstreamAddr(kind, addr string) error {
+	switch kind {
+	case "https":
+		endpoint, err := url.Parse(addr)
+		if err != nil || endpoint.Scheme != "https" || endpoint.Hostname() == "" {
+			return fmt.Errorf("invalid DoH upstream URL: %s", addr)
+		}
+	case "dnscrypt":
+		if !strings.HasPrefix(addr, "sdns://") {
+			return fmt.Errorf("invalid DNSCrypt upstream stamp: %s", addr)
+		}
+	default:
+		host, port, err := net.SplitHostPort(addr)
+		if err != nil || host == "" {
+			return fmt.Errorf("invalid upstream address: %s", addr)
+		}
+		if _, err = strconv.ParseUint(port, 10, 16); err != nil {
+			return fmt.Errorf("invalid upstream port: %s", addr)
+		}
 	}
-	return newUpstream(kind, upstreamAddr, socks5ProxyAddr, timeout)
+	return nil
 }
@@ -0,0 +1,134 @@
+package upstream
+
+import (
+	"math"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// Weight of the latest sample in moving averages
+	statsSmoothing = 0.3
+	// RTT sample is capped so a single slow response won't starve the upstream
+	statsMaxRTT = 300 * time.Millisecond
+	// Score penalty of an always failing upstream, in milliseconds
+	statsErrorPenalty = 1000
+	// Unselected upstreams decay so they will be tried again
+	statsDecay = 0.98
+	// Number of recent RTT samples kept for percentile
+	statsSamples = 64
+)
+
+// stats of an upstream, it's safe for concurrent use
+type stats struct {
+	// srtt is smoothed RTT of successful exchanges in milliseconds
+	srtt float64
+	// errorRate is smoothed ratio of failed exchanges
+	errorRate float64
+	// samples is a ring of recent RTT of successful exchanges
+	samples     [statsSamples]time.Duration
+	sampleCount int
+	lock        sync.RWMutex
+	inflight    atomic.Int64
+}
+
+// begin marks an exchange as in-flight, it should be followed by end or cancel
+func (s *stats) begin() {
+	s.inflight.Add(1)
+}
+
+// end records outcome of the exchange
+func (s *stats) end(rtt time.Duration, err error) {
+	s.inflight.Add(-1)
+	s.record(rtt, err)
+}
+
+// cancel records an exchange interrupted by caller, elapsed time is the lower bound of its RTT.
+// It only makes the upstream slower, a quickly cancelled exchange tells nothing.
+func (s *stats) cancel(elapsed time.Duration) {
+	s.inflight.Add(-1)
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if float64(elapsed)/float64(time.Millisecond) > s.srtt {
+		s.addRTT(elapsed)
+	}
+}
+
+func (s *stats) record(rtt time.Duration, err error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if err != nil {
+		s.errorRate = s.errorRate*(1-statsSmoothing) + statsSmoothing
+		return
+	}
+	s.samples[s.sampleCount%statsSamples] = rtt
+	s.sampleCount++
+	s.addRTT(rtt)
+	s.errorRate *= 1 - statsSmoothing
+}
+
+func (s *stats) addRTT(rtt time.Duration) {
+	if rtt > statsMaxRTT {
+		rtt = statsMaxRTT
+	}
+	ms := float64(rtt) / float64(time.Millisecond)
+	s.srtt = s.srtt*(1-statsSmoothing) + ms*statsSmoothing
+}
+
+func (s *stats) decay() {
+	s.lock.Lock()
+	s.srtt *= statsDecay
+	s.errorRate *= statsDecay
+	s.lock.Unlock()
+}
+
+// getSRTT returns smoothed RTT of successful exchanges
+func (s *stats) getSRTT() time.Duration {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	return time.Duration(s.srtt * float64(time.Millisecond))
+}
+
+// getErrorRate returns smoothed ratio of failed exchanges
+func (s *stats) getErrorRate() float64 {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	return s.errorRate
+}
+
+// getPercentile returns the p-th percentile of recent RTT, false if there is no sample
+func (s *stats) getPercentile(p float64) (time.Duration, bool) {
+	s.lock.RLock()
+	n := s.sampleCount
+	if n > statsSamples {
+		n = statsSamples
+	}
+	samples := append([]time.Duration(nil), s.samples[:n]...)
+	s.lock.RUnlock()
+	if n == 0 {
+		return 0, false
+	}
+	sort.Slice(samples, func(i, j int) bool {
+		return samples[i] < samples[j]
+	})
+	index := int(math.Ceil(p/100*float64(n))) - 1
+	if index < 0 {
+		index = 0
+	}
+	return samples[index], true
+}
+
+// getInflight returns the number of exchanges waiting for response
+func (s *stats) getInflight() int64 {
+	return s.inflight.Load()
+}
+
+// score estimates the latency of next exchange, lower is better.
+// Queued exchanges and failures make the upstream slower.
+func (s *stats) score() float64 {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	return s.srtt*float64(1+s.inflight.Load()) + s.errorRate*statsErrorPenalty
+}
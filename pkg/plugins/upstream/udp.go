@@ -0,0 +1,41 @@
+package upstream
+
+import (
+	"context"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// Advertised EDNS0 buffer size which avoids IP fragmentation, as DNS Flag Day 2020 recommended
+const defaultUDPSize = 1232
+
+// exchangeViaUDP sends query with EDNS0, the query is sent again over TCP if response is truncated
+func (u *ups) exchangeViaUDP(ctx context.Context, msg *dns.Msg) (*dns.Msg, time.Duration, error) {
+	query := msg.Copy()
+	if opt := query.IsEdns0(); opt != nil {
+		opt.SetUDPSize(u.udpSize)
+	} else {
+		query.SetEdns0(u.udpSize, false)
+	}
+	response, rtt, err := u.exchangeViaConn(ctx, query)
+	if err == nil && response != nil && response.Truncated {
+		// Truncated response is useless to client and cache, retry with the same server over TCP
+		var tcpRTT time.Duration
+		response, tcpRTT, err = u.exchangeViaTCP(ctx, query)
+		rtt += tcpRTT
+	}
+	if response != nil && msg.IsEdns0() == nil {
+		removeOPT(response)
+	}
+	return response, rtt, err
+}
+
+func (u *ups) exchangeViaTCP(ctx context.Context, msg *dns.Msg) (*dns.Msg, time.Duration, error) {
+	conn, err := u.dial(ctx, "tcp")
+	if err != nil {
+		return nil, 0, err
+	}
+	defer conn.Close()
+	return u.exchangeWithCoon(ctx, conn, msg)
+}
@@ -2,39 +2,123 @@ package upstream
 
 import (
 	"context"
+	"crypto/tls"
+	"errors"
 	"io"
 	"net"
+	"net/http"
+	"net/url"
+	"sync"
+	"sync/atomic"
 	"time"
 
+	"github.com/blho/apexdns/pkg/utils/tlsutil"
+
 	"github.com/miekg/dns"
+	"github.com/quic-go/quic-go"
 	"golang.org/x/net/proxy"
 )
 
+// upstreamOptions are the optional `key=value` arguments of upstream
+type upstreamOptions struct {
+	socks5ProxyAddr string
+	tls             tlsutil.ClientOptions
+	doh             dohOptions
+	pool            poolOptions
+	weight          int
+	udpSize         uint16
+	dial            dialOptions
+}
+
 type ups struct {
 	net             string
 	addr            string
 	socks5ProxyAddr string
-	socks5DialFunc  proxy.Dialer
+	socks5DialFunc  proxy.ContextDialer
+	tlsConfig       *tls.Config
 	timeout         time.Duration
-	srtt            float64
+	weight          int
+	udpSize         uint16
+	dialOpts        dialOptions
+	stats           stats
 	dnsClient       *dns.Client
+	pool            *connPool
+	// DNS over HTTPS
+	httpClient        *http.Client
+	doh               dohOptions
+	wireFormatRetryAt atomic.Int64
+	// DNS over QUIC
+	quicConfig    *quic.Config
+	quicConn      *quic.Conn
+	quicIdleTimer *time.Timer
+	quicLock      sync.Mutex
+	// DNSCrypt
+	dnscrypt *dnscryptResolver
+	// bootstrap resolves hostname of upstream
+	bootstrap *bootstrapResolver
+	// unhealthy upstream is taken out of selection by health check
+	unhealthy atomic.Bool
+	// done is closed once upstream is removed, background tasks should stop
+	done chan struct{}
 }
 
-func newUpstream(net, addr, socks5ProxyAddr string, timeout time.Duration) (*ups, error) {
+func newUpstream(net, addr string, opts upstreamOptions, timeout time.Duration) (*ups, error) {
 	u := &ups{
 		net:             net,
 		addr:            addr,
 		timeout:         timeout,
-		socks5ProxyAddr: socks5ProxyAddr,
-		srtt:            0,
+		socks5ProxyAddr: opts.socks5ProxyAddr,
+		weight:          opts.weight,
+		udpSize:         opts.udpSize,
+		dialOpts:        opts.dial,
 		dnsClient:       nil,
+		doh:             opts.doh,
+		done:            make(chan struct{}),
+	}
+	if net == "tcp-tls" || net == "https" || net == "quic" {
+		if err := u.setupTLSConfig(opts.tls); err != nil {
+			return nil, err
+		}
 	}
-	if socks5ProxyAddr != "" {
-		socks5Proxy, err := proxy.SOCKS5("tcp", u.socks5ProxyAddr, nil, nil)
+	if net == "quic" {
+		if u.socks5ProxyAddr != "" {
+			return nil, errors.New("QUIC upstream can't work through SOCKS5 proxy")
+		}
+		u.setupQUICConfig()
+	}
+	if err := u.dialOpts.validate(); err != nil {
+		return nil, err
+	}
+	if net == "dnscrypt" {
+		if u.socks5ProxyAddr != "" {
+			return nil, errors.New("DNSCrypt upstream can't work through SOCKS5 proxy")
+		}
+		if u.dialOpts.isSet() {
+			return nil, errors.New("DNSCrypt upstream doesn't support dial options")
+		}
+		if err := u.setupDNSCrypt(); err != nil {
+			return nil, err
+		}
+	}
+	if u.socks5ProxyAddr != "" {
+		// Dial options apply to connections to the proxy
+		socks5Proxy, err := proxy.SOCKS5("tcp", u.socks5ProxyAddr, nil, u.newDialer("tcp"))
 		if err != nil {
 			return nil, err
 		}
-		u.socks5DialFunc = socks5Proxy
+		contextDialer, ok := socks5Proxy.(proxy.ContextDialer)
+		if !ok {
+			return nil, errors.New("SOCKS5 dialer doesn't support context")
+		}
+		u.socks5DialFunc = contextDialer
+	}
+	if net == "tcp" || net == "tcp-tls" {
+		u.pool = newConnPool(u.getConn, u.timeout, opts.pool)
+	}
+	if net == "https" {
+		if err := u.setupHTTPClient(); err != nil {
+			return nil, err
+		}
 	}
 	err := u.setupDNSClient()
 	if err != nil {
@@ -43,6 +127,11 @@ func newUpstream(net, addr, socks5ProxyAddr string, timeout time.Duration) (*ups
 	return u, nil
 }
 
+// close stops background tasks of upstream
+func (u *ups) close() {
+	close(u.done)
+}
+
 func (u *ups) getNetwork() string {
 	switch u.net {
 	case "tcp-tls":
@@ -52,8 +141,17 @@ func (u *ups) getNetwork() string {
 	}
 }
 
-func (u *ups) srttAttenuation() {
-	u.srtt *= 0.98
+// getHost returns host of upstream address or URL
+func (u *ups) getHost() (string, error) {
+	if u.net == "https" {
+		endpoint, err := url.Parse(u.addr)
+		if err != nil {
+			return "", err
+		}
+		return endpoint.Hostname(), nil
+	}
+	host, _, err := net.SplitHostPort(u.addr)
+	return host, err
 }
 
 func (u *ups) setupDNSClient() error {
@@ -69,23 +167,67 @@ func (u *ups) setupDNSClient() error {
 	return nil
 }
 
-func (u *ups) getConn() (net.Conn, error) {
-	dialer := net.Dialer{Timeout: u.timeout}
-	dialFunc := dialer.Dial
-	network := u.getNetwork()
+func (u *ups) setupTLSConfig(opts tlsutil.ClientOptions) error {
+	if opts.ServerName == "" {
+		// Verify against the host of address by default
+		host, err := u.getHost()
+		if err != nil {
+			return err
+		}
+		opts.ServerName = host
+	}
+	tlsConfig, err := tlsutil.NewClientConfig(opts)
+	if err != nil {
+		return err
+	}
+	u.tlsConfig = tlsConfig
+	return nil
+}
+
+func (u *ups) getConn(ctx context.Context) (net.Conn, error) {
+	return u.dial(ctx, u.getNetwork())
+}
+
+func (u *ups) dial(ctx context.Context, network string) (net.Conn, error) {
+	dialContext := u.newDialer(network).DialContext
 	if u.socks5DialFunc != nil {
-		dialFunc = u.socks5DialFunc.Dial
+		dialContext = u.socks5DialFunc.DialContext
 		network = "tcp"
 	}
-	return dialFunc(network, u.addr)
+	conn, err := dialResolved(ctx, u, u.addr, func(ctx context.Context, addr string) (net.Conn, error) {
+		return dialContext(ctx, network, addr)
+	})
+	if err != nil {
+		return nil, err
+	}
+	if u.tlsConfig != nil {
+		tlsConn := tls.Client(conn, u.tlsConfig)
+		if u.timeout > 0 {
+			tlsConn.SetDeadline(time.Now().Add(u.timeout))
+		}
+		if err = tlsConn.HandshakeContext(ctx); err != nil {
+			conn.Close()
+			return nil, err
+		}
+		conn = tlsConn
+	}
+	return conn, nil
 }
 
-func (u *ups) exchangeWithCoon(conn net.Conn, msg *dns.Msg) (*dns.Msg, time.Duration, error) {
+func (u *ups) exchangeWithCoon(ctx context.Context, conn net.Conn, msg *dns.Msg) (*dns.Msg, time.Duration, error) {
 	startAt := time.Now()
+	if u.timeout > 0 {
+		conn.SetDeadline(startAt.Add(u.timeout))
+	}
+	// Interrupt blocking read and write if exchange is cancelled
+	stop := context.AfterFunc(ctx, func() {
+		conn.SetDeadline(time.Now())
+	})
+	defer stop()
 	c := &dns.Conn{
 		Conn: conn,
 	}
-	if u.getNetwork() == "udp" {
+	if _, ok := conn.(net.PacketConn); ok {
 		c.UDPSize = dns.MaxMsgSize
 	}
 	if err := c.WriteMsg(msg); err != nil {
@@ -100,28 +242,52 @@ func (u *ups) exchangeViaClient(ctx context.Context, msg *dns.Msg) (r *dns.Msg,
 	return r, rtt, err
 }
 
-func (u *ups) exchangeViaConn(msg *dns.Msg) (*dns.Msg, time.Duration, error) {
-	// TODO(@oif): Add pool support
-	conn, err := u.getConn()
+func (u *ups) exchangeViaConn(ctx context.Context, msg *dns.Msg) (*dns.Msg, time.Duration, error) {
+	if u.pool != nil {
+		return u.pool.exchange(ctx, msg)
+	}
+	conn, err := u.getConn(ctx)
 	if err != nil {
 		return nil, 0, err
 	}
 	defer conn.Close()
-	return u.exchangeWithCoon(conn, msg)
+	response, rtt, err := u.exchangeWithCoon(ctx, conn, msg)
+	if err != nil && ctx.Err() == nil {
+		// Dialing UDP doesn't tell whether the address is reachable
+		if host, _, splitErr := net.SplitHostPort(u.addr); splitErr == nil {
+			u.reportAddr(host, conn.RemoteAddr().String(), err)
+		}
+	}
+	return response, rtt, err
 }
 
-func (u *ups) Exchange(msg *dns.Msg) (*dns.Msg, time.Duration, error) {
-	response, rtt, err := u.exchangeViaConn(msg)
-	go func(ms float64, hasError bool) {
-		if hasError {
-			u.srtt = u.srtt + 200
-			return
-		}
-		if ms > 300 {
-			ms = 300
-		}
-		u.srtt = u.srtt*0.7 + ms*0.3
-	}(float64(rtt/time.Millisecond), err != nil)
+// Exchange sends query to upstream, it returns once ctx is cancelled
+func (u *ups) Exchange(ctx context.Context, msg *dns.Msg) (*dns.Msg, time.Duration, error) {
+	var (
+		response *dns.Msg
+		rtt      time.Duration
+		err      error
+	)
+	u.stats.begin()
+	switch u.net {
+	case "https":
+		response, rtt, err = u.exchangeViaHTTPS(ctx, msg)
+	case "quic":
+		response, rtt, err = u.exchangeViaQUIC(ctx, msg)
+	case "dnscrypt":
+		response, rtt, err = u.exchangeViaDNSCrypt(ctx, msg)
+	case "udp":
+		response, rtt, err = u.exchangeViaUDP(ctx, msg)
+	default:
+		response, rtt, err = u.exchangeViaConn(ctx, msg)
+	}
+	if err != nil && ctx.Err() != nil {
+		// Interrupted by caller, it's not a failure of upstream
+		err = ctx.Err()
+		u.stats.cancel(rtt)
+	} else {
+		u.stats.end(rtt, err)
+	}
 	if err == io.EOF {
 		err = nil
 	}
@@ -2,6 +2,8 @@ package server
 
 import (
 	"bytes"
+	"errors"
+	"fmt"
 	"io/ioutil"
 	"strings"
 
@@ -134,8 +136,16 @@ func (s *Server) handleContext(ctx *types.Context) {
 		logger.WithError(err).Warn("Unable to handle context")
 		return
 	}
+	if len(ctx.GetQueryMessage().Question) == 0 {
+		ctx.AbortWithErr(errors.New("no question in query message"))
+		return
+	}
 	// Find the engine to handle this context
 	eng := s.findBestMatchZoneEngine(ctx.GetQueryMessage().Question[0].Name)
+	if eng == nil {
+		ctx.AbortWithErr(fmt.Errorf("%w: no zone matches %s", types.ErrRefused, ctx.GetQueryMessage().Question[0].Name))
+		return
+	}
 	eng.Handle(ctx)
 }
 
@@ -154,12 +164,12 @@ func (s *Server) findBestMatchZoneEngine(fqdn string) *Engine {
 
 func (s *Server) Run() {
 	for _, endpoint := range s.endpoints {
-		go func() {
+		go func(endpoint types.Endpoint) {
 			err := endpoint.Run()
 			if err != nil {
 				s.logger.WithError(err).Fatal("Failed to run endpoint")
 			}
-		}()
+		}(endpoint)
 	}
 }
 
@@ -14,6 +14,7 @@ import (
 type Context struct {
 	uuid            string
 	clientIP        net.IP
+	clientIdentity  string
 	queryMessage    *dns.Msg
 	responseMessage *dns.Msg
 	isAbort         bool
@@ -90,11 +91,24 @@ func (c *Context) ClientIP() net.IP {
 	return c.clientIP
 }
 
+// SetClientIdentity sets the identity of authenticated client
+func (c *Context) SetClientIdentity(identity string) {
+	c.clientIdentity = identity
+}
+
+// ClientIdentity returns the identity of authenticated client, empty if unauthenticated
+func (c *Context) ClientIdentity() string {
+	return c.clientIdentity
+}
+
 func (c *Context) GetLogger(logger *logrus.Entry) *logrus.Entry {
 	fields := logrus.Fields{}
 	if clientIP := c.ClientIP(); clientIP != nil {
 		fields["clientIP"] = clientIP
 	}
+	if identity := c.ClientIdentity(); identity != "" {
+		fields["client"] = identity
+	}
 	if query := c.GetQueryMessage(); query != nil && len(query.Question) > 0 {
 		fields["question"] = query.Question[0].String()
 	}
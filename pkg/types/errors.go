@@ -0,0 +1,6 @@
+package types
+
+import "errors"
+
+// ErrRefused indicates the query is refused to resolve, which should be answered with REFUSED
+var ErrRefused = errors.New("query refused")
@@ -0,0 +1,55 @@
+package dnsutil
+
+import (
+	"errors"
+
+	"github.com/blho/apexdns/pkg/types"
+
+	"github.com/miekg/dns"
+)
+
+// Reply returns the message which should be written back to client for the handled context,
+// a SERVFAIL or REFUSED message will be built if context failed or no response generated
+func Reply(ctx *types.Context) *dns.Msg {
+	query := ctx.GetQueryMessage()
+	resp := ctx.GetResponse()
+	if err := ctx.Error(); errors.Is(err, types.ErrRefused) {
+		return new(dns.Msg).SetRcode(query, dns.RcodeRefused)
+	} else if err != nil || resp == nil {
+		return new(dns.Msg).SetRcode(query, dns.RcodeServerFailure)
+	}
+	// Response may come from cache which shared between queries, so copy it before modify
+	resp = resp.Copy()
+	resp.Id = query.Id
+	return resp
+}
+
+// UDPSize returns the maximum response size that client could accept over UDP
+func UDPSize(query *dns.Msg) int {
+	size := dns.MinMsgSize
+	if opt := query.IsEdns0(); opt != nil && int(opt.UDPSize()) > size {
+		size = int(opt.UDPSize())
+	}
+	return size
+}
+
+// MinTTL returns the minimum TTL of records in message, ok is false if no record found.
+// For negative answers, TTL of SOA is capped by its MINIMUM field as RFC 2308 described
+func MinTTL(msg *dns.Msg) (ttl uint32, ok bool) {
+	for _, rrs := range [][]dns.RR{msg.Answer, msg.Ns, msg.Extra} {
+		for _, rr := range rrs {
+			if rr.Header().Rrtype == dns.TypeOPT {
+				continue
+			}
+			rrTTL := rr.Header().Ttl
+			if soa, isSOA := rr.(*dns.SOA); isSOA && len(msg.Answer) == 0 && soa.Minttl < rrTTL {
+				rrTTL = soa.Minttl
+			}
+			if !ok || rrTTL < ttl {
+				ttl = rrTTL
+				ok = true
+			}
+		}
+	}
+	return ttl, ok
+}
@@ -0,0 +1,54 @@
+package netutil
+
+import (
+	"fmt"
+	"net"
+	"strings"
+)
+
+// ParseCIDRs parses CIDR list, bare IP is treated as a single host network
+func ParseCIDRs(args []string) ([]*net.IPNet, error) {
+	networks := make([]*net.IPNet, 0, len(args))
+	for _, arg := range args {
+		if !strings.Contains(arg, "/") {
+			ip := net.ParseIP(arg)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid IP: %s", arg)
+			}
+			bits := 128
+			if ip.To4() != nil {
+				ip = ip.To4()
+				bits = 32
+			}
+			networks = append(networks, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, ipNet, err := net.ParseCIDR(arg)
+		if err != nil {
+			return nil, fmt.Errorf("invalid CIDR: %s", arg)
+		}
+		networks = append(networks, ipNet)
+	}
+	return networks, nil
+}
+
+// ContainsIP reports whether any of the networks contains the IP
+func ContainsIP(networks []*net.IPNet, ip net.IP) bool {
+	for _, ipNet := range networks {
+		if ipNet.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// IPFromAddr returns IP of TCP or UDP address
+func IPFromAddr(addr net.Addr) net.IP {
+	switch a := addr.(type) {
+	case *net.TCPAddr:
+		return a.IP
+	case *net.UDPAddr:
+		return a.IP
+	}
+	return nil
+}
@@ -0,0 +1,67 @@
+package proxyprotocol
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"net"
+
+	"github.com/blho/apexdns/pkg/utils/netutil"
+
+	"github.com/pires/go-proxyproto"
+)
+
+const (
+	// Fixed size of PROXY protocol v2 header before addresses
+	v2HeaderSize = 16
+)
+
+// ParseAllowed parses arguments of proxy_protocol option, which are CIDRs of balancers allowed to send header:
+//
+//	proxy_protocol <balancer CIDR>...
+func ParseAllowed(args []string) ([]*net.IPNet, error) {
+	if len(args) == 0 {
+		return nil, errors.New("proxy_protocol requires at least one CIDR")
+	}
+	return netutil.ParseCIDRs(args)
+}
+
+func policy(allowed []*net.IPNet) proxyproto.PolicyFunc {
+	return func(upstream net.Addr) (proxyproto.Policy, error) {
+		if netutil.ContainsIP(allowed, netutil.IPFromAddr(upstream)) {
+			return proxyproto.USE, nil
+		}
+		// Header from others will be stripped without use
+		return proxyproto.IGNORE, nil
+	}
+}
+
+// NewListener returns a listener which accepts PROXY protocol v1/v2 header from allowed balancers,
+// RemoteAddr of accepted connections will be the address in header
+func NewListener(listener net.Listener, allowed []*net.IPNet) net.Listener {
+	return &proxyproto.Listener{
+		Listener: listener,
+		Policy:   policy(allowed),
+	}
+}
+
+// ReadPacketHeader strips PROXY protocol v2 header from datagram which sent by allowed balancers,
+// returns the payload and the source address in header
+func ReadPacketHeader(packet []byte, peer net.Addr, allowed []*net.IPNet) ([]byte, net.Addr, error) {
+	if !bytes.HasPrefix(packet, proxyproto.SIGV2) || !netutil.ContainsIP(allowed, netutil.IPFromAddr(peer)) {
+		return packet, peer, nil
+	}
+	header, err := proxyproto.Read(bufio.NewReader(bytes.NewReader(packet)))
+	if err != nil {
+		return nil, nil, err
+	}
+	headerSize := v2HeaderSize + int(binary.BigEndian.Uint16(packet[14:16]))
+	if headerSize > len(packet) {
+		return nil, nil, errors.New("invalid PROXY protocol header length")
+	}
+	if header.Command.IsLocal() || header.SourceAddr == nil {
+		return packet[headerSize:], peer, nil
+	}
+	return packet[headerSize:], header.SourceAddr, nil
+}
@@ -0,0 +1,44 @@
+package tlsutil
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"io/ioutil"
+)
+
+// SetClientCA makes server verify client certificates against the CA file,
+// client certificate is mandatory if require is true
+func SetClientCA(config *tls.Config, caFile string, require bool) error {
+	raw, err := ioutil.ReadFile(caFile)
+	if err != nil {
+		return err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(raw) {
+		return errors.New("no certificate found in client CA file: " + caFile)
+	}
+	config.ClientCAs = pool
+	if require {
+		config.ClientAuth = tls.RequireAndVerifyClientCert
+	} else {
+		config.ClientAuth = tls.VerifyClientCertIfGiven
+	}
+	return nil
+}
+
+// PeerIdentity returns the identity of verified client certificate, which is the common name
+// or the first DNS name of certificate, empty if client is unverified
+func PeerIdentity(state tls.ConnectionState) string {
+	if len(state.VerifiedChains) == 0 || len(state.VerifiedChains[0]) == 0 {
+		return ""
+	}
+	cert := state.VerifiedChains[0][0]
+	if cert.Subject.CommonName != "" {
+		return cert.Subject.CommonName
+	}
+	if len(cert.DNSNames) > 0 {
+		return cert.DNSNames[0]
+	}
+	return cert.SerialNumber.String()
+}
@@ -0,0 +1,100 @@
+package tlsutil
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"strings"
+)
+
+// ParseVersion parses TLS version like `1.2` and `1.3`
+func ParseVersion(raw string) (uint16, error) {
+	switch raw {
+	case "1.0":
+		return tls.VersionTLS10, nil
+	case "1.1":
+		return tls.VersionTLS11, nil
+	case "1.2":
+		return tls.VersionTLS12, nil
+	case "1.3":
+		return tls.VersionTLS13, nil
+	default:
+		return 0, fmt.Errorf("unknown TLS version: %s", raw)
+	}
+}
+
+// NewServerConfig returns server side TLS config which serves reloadable certificate
+func NewServerConfig(certFile, keyFile string, nextProtos ...string) (*tls.Config, error) {
+	reloader, err := NewCertReloader(certFile, keyFile)
+	if err != nil {
+		return nil, err
+	}
+	return &tls.Config{
+		MinVersion:     tls.VersionTLS12,
+		MaxVersion:     tls.VersionTLS13,
+		GetCertificate: reloader.GetCertificate,
+		NextProtos:     nextProtos,
+	}, nil
+}
+
+const (
+	clientSessionCacheSize = 64
+)
+
+// ClientOptions of TLS client
+type ClientOptions struct {
+	// ServerName used for SNI and certificate verification
+	ServerName string
+	// CAFile verifies server certificate instead of system roots if set
+	CAFile string
+	// Pins are base64 encoded SHA-256 digests of SubjectPublicKeyInfo, one of the certificates
+	// in verified chain must match any of them if set
+	Pins []string
+}
+
+// NewClientConfig returns client side TLS config with session resumption enabled
+func NewClientConfig(opts ClientOptions, nextProtos ...string) (*tls.Config, error) {
+	config := &tls.Config{
+		ServerName:         opts.ServerName,
+		MinVersion:         tls.VersionTLS12,
+		NextProtos:         nextProtos,
+		ClientSessionCache: tls.NewLRUClientSessionCache(clientSessionCacheSize),
+	}
+	if opts.CAFile != "" {
+		raw, err := ioutil.ReadFile(opts.CAFile)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(raw) {
+			return nil, errors.New("no certificate found in CA file: " + opts.CAFile)
+		}
+		config.RootCAs = pool
+	}
+	if len(opts.Pins) > 0 {
+		pins := make(map[string]struct{}, len(opts.Pins))
+		for _, pin := range opts.Pins {
+			digest, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(pin, "sha256/"))
+			if err != nil || len(digest) != sha256.Size {
+				return nil, fmt.Errorf("invalid SPKI pin: %s", pin)
+			}
+			pins[string(digest)] = struct{}{}
+		}
+		config.VerifyConnection = func(state tls.ConnectionState) error {
+			for _, chain := range state.VerifiedChains {
+				for _, cert := range chain {
+					digest := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+					if _, ok := pins[string(digest[:])]; ok {
+						return nil
+					}
+				}
+			}
+			return errors.New("no SPKI pin matched")
+		}
+	}
+	return config, nil
+}
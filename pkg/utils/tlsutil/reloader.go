@@ -0,0 +1,77 @@
+package tlsutil
+
+import (
+	"crypto/tls"
+	"os"
+	"sync"
+	"time"
+)
+
+const (
+	// reloadCheckInterval limits how often the certificate files are checked
+	reloadCheckInterval = 5 * time.Second
+)
+
+// CertReloader loads key pair from files and reloads it once files change on disk
+type CertReloader struct {
+	certFile    string
+	keyFile     string
+	cert        *tls.Certificate
+	modTime     time.Time
+	lastCheckAt time.Time
+	lock        sync.Mutex
+}
+
+// NewCertReloader returns a reloader with the key pair loaded
+func NewCertReloader(certFile, keyFile string) (*CertReloader, error) {
+	r := &CertReloader{
+		certFile: certFile,
+		keyFile:  keyFile,
+	}
+	modTime, err := r.latestModTime()
+	if err != nil {
+		return nil, err
+	}
+	if err = r.load(modTime); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+func (r *CertReloader) latestModTime() (time.Time, error) {
+	var latest time.Time
+	for _, file := range []string{r.certFile, r.keyFile} {
+		info, err := os.Stat(file)
+		if err != nil {
+			return latest, err
+		}
+		if info.ModTime().After(latest) {
+			latest = info.ModTime()
+		}
+	}
+	return latest, nil
+}
+
+func (r *CertReloader) load(modTime time.Time) error {
+	cert, err := tls.LoadX509KeyPair(r.certFile, r.keyFile)
+	if err != nil {
+		return err
+	}
+	r.cert = &cert
+	r.modTime = modTime
+	return nil
+}
+
+// GetCertificate implements tls.Config.GetCertificate, the previous certificate
+// will be kept if the changed files are unable to load(e.g. in the middle of writing)
+func (r *CertReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if time.Since(r.lastCheckAt) > reloadCheckInterval {
+		r.lastCheckAt = time.Now()
+		if modTime, err := r.latestModTime(); err == nil && !modTime.Equal(r.modTime) {
+			_ = r.load(modTime)
+		}
+	}
+	return r.cert, nil
+}